@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Deadlines for one API call. Uploads get longer since sources can be large.
+// moravia_request_timeout and moravia_upload_timeout are durations like 90s or 15m.
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeoutFromEnvironment("moravia_request_timeout", time.Minute))
+}
+
+func uploadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeoutFromEnvironment("moravia_upload_timeout", 10*time.Minute))
+}
+
+// Rolling back has to work after the run's context is cancelled, so it gets
+// a context of its own
+func rollbackContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), timeoutFromEnvironment("moravia_request_timeout", time.Minute))
+}
+
+func timeoutFromEnvironment(key string, fallback time.Duration) time.Duration {
+	value := getenv(key, "")
+	if value == "" {
+		return fallback
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		logs.Warn("Ignoring "+key+", expected a duration like 90s", "value", value)
+		return fallback
+	}
+	return timeout
+}
+
+// Cancelled on the first SIGINT or SIGTERM, which stops in-flight requests and
+// lets the run roll back and write its report. A second signal exits at once.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		received := <-signals
+		logs.Warn("Received " + received.String() + ", stopping. Send it again to exit immediately.")
+		cancel()
+		<-signals
+		logs.Error("Exiting without cleaning up, jobs may be left in Moravia")
+		os.Exit(130)
+	}()
+	return ctx
+}
+
+// Whether err is from the run being cancelled, rather than a deadline or the API
+func isCancelled(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == context.Canceled
+}
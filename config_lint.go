@@ -0,0 +1,773 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// A problem with the configuration at a path like job_templates[1].custom_fields[0].type
+type configError struct {
+	File    string
+	Line    int
+	Column  int
+	Path    string
+	Message string
+	Warning bool // Doesn't make the configuration invalid
+}
+
+func (e configError) Error() string {
+	location := e.File
+	if e.Line > 0 {
+		location += fmt.Sprintf(":%d:%d", e.Line, e.Column)
+	}
+	if e.Path != "" {
+		return location + ": " + e.Path + ": " + e.Message
+	}
+	return location + ": " + e.Message
+}
+
+type configErrors []configError
+
+func (errs configErrors) hasErrors() bool {
+	for _, err := range errs {
+		if !err.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// Fills in the file and position of every error, and puts them in file order
+func (errs configErrors) locate(file string, positions yamlPositions) configErrors {
+	located := make(configErrors, len(errs))
+	for i, err := range errs {
+		if err.File != "" {
+			// Already located in another file
+			located[i] = err
+			continue
+		}
+		err.File = file
+		if position, ok := positions.find(err.Path); ok {
+			if position.File != "" {
+				err.File = position.File
+			}
+			err.Line = position.Line
+			err.Column = position.Column
+		}
+		located[i] = err
+	}
+	sort.SliceStable(located, func(i, j int) bool {
+		if located[i].File != located[j].File {
+			// The file being read first, then its overlay
+			return located[i].File == file
+		}
+		if located[i].Line != located[j].Line {
+			return located[i].Line < located[j].Line
+		}
+		return located[i].Column < located[j].Column
+	})
+	return located
+}
+
+// Leaves out errors about values that were dropped while reading, because
+// they're an undefined variable or of the wrong type, so "a project id is
+// required" isn't reported for id: ${PROJECT} or id: abc. Values at the top
+// level or in job_defaults are inherited by every template.
+func (errs configErrors) withoutDropped(dropped configErrors) configErrors {
+	var kept configErrors
+	for _, err := range errs {
+		reported := false
+		for _, earlier := range dropped {
+			if earlier.Path == "" {
+				continue
+			}
+			path := err.Path
+			if inherited, ok := inheritedConfigPath(earlier.Path); ok {
+				path = templateRelativeConfigPath(path)
+				if path == inherited || strings.HasPrefix(path, inherited+".") {
+					reported = true
+				}
+			}
+			if err.Path == earlier.Path || strings.HasPrefix(err.Path, earlier.Path+".") || strings.HasPrefix(err.Path, earlier.Path+"[") {
+				reported = true
+			}
+		}
+		if !reported {
+			kept = append(kept, err)
+		}
+	}
+	return kept
+}
+
+// Whether the file was decoded, despite errors, so it can be validated. Errors
+// without a path, like YAML syntax errors, stop it being read.
+func (errs configErrors) decoded() bool {
+	for _, err := range errs {
+		if err.Path == "" && !err.Warning {
+			return false
+		}
+	}
+	return true
+}
+
+var templateConfigPath = regexp.MustCompile(`^(job_template|job_templates\[\d+\])\.`)
+
+// The path within a template of a value every template inherits, like
+// project.id for project.id or job_defaults.project.id
+func inheritedConfigPath(path string) (string, bool) {
+	if strings.HasPrefix(path, "job_defaults.") {
+		return strings.TrimPrefix(path, "job_defaults."), true
+	}
+	if templateConfigPath.MatchString(path) {
+		return "", false
+	}
+	return path, true
+}
+
+func templateRelativeConfigPath(path string) string {
+	return templateConfigPath.ReplaceAllString(path, "")
+}
+
+func joinConfigPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+type yamlPosition struct {
+	File   string // Set if it's in an overlay file, not the file being read
+	Line   int
+	Column int
+}
+
+// Where each key and list item of a YAML document is, by config path
+type yamlPositions map[string]yamlPosition
+
+// The position of the first path found. Paths that aren't in the document,
+// like inherited values, fall back to the << merge key that brings them in
+// or else their closest parent.
+func (positions yamlPositions) find(paths ...string) (yamlPosition, bool) {
+	for _, path := range paths {
+		for path != "" {
+			if position, ok := positions[path]; ok {
+				return position, true
+			}
+			cut := strings.LastIndexAny(path, ".[")
+			parent := ""
+			if cut >= 0 {
+				parent = path[:cut]
+			}
+			if cut < 0 || path[cut] == '.' {
+				if position, ok := positions[joinConfigPath(parent, "<<")]; ok {
+					return position, true
+				}
+			}
+			path = parent
+		}
+	}
+	return yamlPosition{}, false
+}
+
+var yamlKeyPattern = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s"'#\-?:,\[\]{}][^:#]*?|-[^\s:#][^:#]*?)\s*:(\s+(.*))?$`)
+
+// yaml.v2 doesn't expose node positions, so block style documents are scanned
+// line by line for keys and list items
+func locateYAMLPaths(text string) yamlPositions {
+	type frame struct {
+		indent int
+		path   string
+		isList bool
+		index  int
+	}
+
+	positions := make(yamlPositions)
+	var stack []frame
+	lastKeyPath := ""
+	blockScalarIndent := -1
+
+	for lineNumber, line := range strings.Split(text, "\n") {
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+		content = strings.TrimRight(content, " \t\r")
+		// Where content ends, for the columns of what's at its end
+		end := indent + len(content)
+
+		if blockScalarIndent >= 0 {
+			if content == "" || indent > blockScalarIndent {
+				continue
+			}
+			blockScalarIndent = -1
+		}
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" || content == "..." {
+			continue
+		}
+
+		isItem := content == "-" || strings.HasPrefix(content, "- ")
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if top.indent > indent || (top.indent == indent && top.isList && !isItem) {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			break
+		}
+
+		if isItem {
+			if len(stack) > 0 && stack[len(stack)-1].isList && stack[len(stack)-1].indent == indent {
+				stack[len(stack)-1].index++
+			} else {
+				stack = append(stack, frame{indent: indent, path: lastKeyPath, isList: true})
+			}
+			list := stack[len(stack)-1]
+			itemPath := fmt.Sprintf("%s[%d]", list.path, list.index)
+			positions[itemPath] = yamlPosition{Line: lineNumber + 1, Column: indent + 1}
+			lastKeyPath = itemPath
+
+			item := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+			rest := withoutYAMLAnchor(item)
+			if strings.HasPrefix(rest, "[") || strings.HasPrefix(rest, "{") {
+				locateYAMLFlow(rest, itemPath, lineNumber+1, end-len(rest)+1, positions)
+				continue
+			}
+			if rest == "" || !yamlKeyPattern.MatchString(rest) {
+				continue
+			}
+			// "- key: value" starts a mapping inside the item, an anchor before
+			// the key is part of its indent
+			indent = end - len(item)
+			content = rest
+			stack = append(stack, frame{indent: indent, path: itemPath})
+		}
+
+		match := yamlKeyPattern.FindStringSubmatch(content)
+		if match == nil {
+			continue
+		}
+		key := strings.Trim(match[1], "\"'")
+		value := withoutYAMLAnchor(match[3])
+
+		if len(stack) == 0 || stack[len(stack)-1].indent != indent || stack[len(stack)-1].isList {
+			parent := lastKeyPath
+			if len(stack) == 0 {
+				parent = ""
+			}
+			stack = append(stack, frame{indent: indent, path: parent})
+		}
+		path := joinConfigPath(stack[len(stack)-1].path, key)
+		positions[path] = yamlPosition{Line: lineNumber + 1, Column: indent + 1}
+		lastKeyPath = path
+
+		if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			blockScalarIndent = indent
+		}
+		if strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{") {
+			locateYAMLFlow(value, path, lineNumber+1, end-len(value)+1, positions)
+		}
+	}
+
+	return positions
+}
+
+var yamlAnchorPattern = regexp.MustCompile(`^&\S+(\s+|$)`)
+
+// Without a leading &anchor, so "- &ios name: iOS" is read as a name key
+func withoutYAMLAnchor(content string) string {
+	return yamlAnchorPattern.ReplaceAllString(content, "")
+}
+
+// Records the keys and items of a flow style value like [de-DE, fr-FR] or
+// {id: 1}, which starts at column on line. Flows that go on past the line
+// are only scanned as far as it goes.
+func locateYAMLFlow(value string, path string, line int, column int, positions yamlPositions) {
+	i := 0
+	skipSpaces := func() {
+		for i < len(value) && value[i] == ' ' {
+			i++
+		}
+	}
+	// Past a scalar, up to the , : or bracket after it
+	skipScalar := func(stops string) {
+		if i < len(value) && (value[i] == '"' || value[i] == '\'') {
+			quote := value[i]
+			for i++; i < len(value); i++ {
+				if value[i] == '\\' && quote == '"' {
+					i++
+				} else if value[i] == quote {
+					i++
+					break
+				}
+			}
+		}
+		for i < len(value) && !strings.ContainsRune(stops, rune(value[i])) {
+			i++
+		}
+	}
+
+	var scan func(path string)
+	scanValue := func(path string) {
+		skipSpaces()
+		if i < len(value) && (value[i] == '[' || value[i] == '{') {
+			scan(path)
+			return
+		}
+		skipScalar(",]}")
+	}
+	scan = func(path string) {
+		isMapping := value[i] == '{'
+		i++
+		for index := 0; ; index++ {
+			skipSpaces()
+			if i >= len(value) || value[i] == '#' {
+				return
+			}
+			if value[i] == ']' || value[i] == '}' {
+				i++
+				return
+			}
+
+			itemPath := fmt.Sprintf("%s[%d]", path, index)
+			if isMapping {
+				start := i
+				skipScalar(":,}")
+				itemPath = joinConfigPath(path, strings.Trim(strings.TrimSpace(value[start:i]), "\"'"))
+				positions[itemPath] = yamlPosition{Line: line, Column: column + start}
+				if i < len(value) && value[i] == ':' {
+					i++
+					scanValue(itemPath)
+				}
+			} else {
+				positions[itemPath] = yamlPosition{Line: line, Column: column + i}
+				scanValue(itemPath)
+			}
+
+			skipSpaces()
+			if i < len(value) && value[i] == ',' {
+				i++
+			}
+		}
+	}
+	scan(path)
+}
+
+// Checks a decoded YAML tree against the configuration types: unknown keys
+// and values of the wrong kind. Those are dropped from the tree, a list item
+// becomes null, so the rest of it can still be decoded and validated.
+func checkConfigurationTree(node interface{}, t reflect.Type, path string) configErrors {
+	if node == nil {
+		return nil
+	}
+	if _, unresolved := node.(unresolvedVariable); unresolved {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var errs configErrors
+	switch t.Kind() {
+	case reflect.Struct:
+		mapping, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return configErrors{{Path: path, Message: "expected a mapping"}}
+		}
+		fields := yamlFields(t)
+		var keys []string
+		for key := range mapping {
+			keys = append(keys, fmt.Sprint(key))
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keyPath := joinConfigPath(path, key)
+			field, known := fields[key]
+			if !known {
+				message := "unknown key \"" + key + "\""
+				if suggestion := closestYAMLField(key, fields); suggestion != "" {
+					message += ", did you mean \"" + suggestion + "\"?"
+				}
+				errs = append(errs, configError{Path: keyPath, Message: message})
+				deleteYAMLKey(mapping, key)
+				continue
+			}
+			var value interface{}
+			for k, v := range mapping {
+				if fmt.Sprint(k) == key {
+					value = v
+				}
+			}
+			valueErrs := checkConfigurationTree(value, field.Type, keyPath)
+			if valueErrs.rejects(keyPath) {
+				deleteYAMLKey(mapping, key)
+			}
+			errs = append(errs, valueErrs...)
+		}
+	case reflect.Map:
+		mapping, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return configErrors{{Path: path, Message: "expected a mapping"}}
+		}
+		for key, value := range mapping {
+			keyPath := joinConfigPath(path, fmt.Sprint(key))
+			valueErrs := checkConfigurationTree(value, t.Elem(), keyPath)
+			if valueErrs.rejects(keyPath) {
+				delete(mapping, key)
+			}
+			errs = append(errs, valueErrs...)
+		}
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+	case reflect.Slice:
+		list, ok := node.([]interface{})
+		if !ok {
+			return configErrors{{Path: path, Message: "expected a list"}}
+		}
+		for i, item := range list {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			itemErrs := checkConfigurationTree(item, t.Elem(), itemPath)
+			if itemErrs.rejects(itemPath) {
+				// Removing it would change the paths of the items after it
+				list[i] = nil
+			}
+			errs = append(errs, itemErrs...)
+		}
+	case reflect.Int:
+		if _, ok := node.(int); !ok {
+			return configErrors{{Path: path, Message: fmt.Sprintf("expected a whole number, got %v", node)}}
+		}
+	case reflect.Bool:
+		if _, ok := node.(bool); !ok {
+			return configErrors{{Path: path, Message: fmt.Sprintf("expected true or false, got %v", node)}}
+		}
+	case reflect.String:
+		switch node.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return configErrors{{Path: path, Message: "expected a single value"}}
+		}
+	}
+	return errs
+}
+
+// Whether errs are about the value at path itself, rather than something in it
+func (errs configErrors) rejects(path string) bool {
+	for _, err := range errs {
+		if err.Path == path && !err.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+func deleteYAMLKey(mapping map[interface{}]interface{}, key string) {
+	for k := range mapping {
+		if fmt.Sprint(k) == key {
+			delete(mapping, k)
+		}
+	}
+}
+
+// The struct fields of a configuration type by their yaml key
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// Catches typos like target_language for target_languages
+func closestYAMLField(key string, fields map[string]reflect.StructField) string {
+	best, bestDistance := "", 3
+	for name := range fields {
+		distance := editDistance(key, name)
+		if distance < bestDistance || (distance == bestDistance && best != "" && name < best) {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	min := values[0]
+	for _, value := range values[1:] {
+		if value < min {
+			min = value
+		}
+	}
+	return min
+}
+
+// BCP 47 style, e.g. en, en-US, zh-Hant-TW
+var languageTagPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// Checks every job template the way submit would use it: required fields,
+// language tags, custom field types and values, and that files exist
+func validateConfiguration(configuration MoraviaConfiguration, file string, positions yamlPositions) configErrors {
+	var errs configErrors
+
+	templates, err := resolveJobTemplates(configuration)
+	if err != nil {
+		return configErrors{{Path: "job_templates", Message: err.Error()}}.locate(file, positions)
+	}
+	if len(templates) == 0 {
+		return configErrors{{Message: "a job_template or job_templates is required"}}.locate(file, positions)
+	}
+
+	// Where each template is written, so errors point at it rather than at the defaults
+	templatePaths := make(map[string]string)
+	templateFields := make(map[string][]MoraviaJobCustomFieldConfiguration)
+	if !reflect.DeepEqual(configuration.Job_template, MoraviaJobTemplateConfiguration{}) {
+		templatePaths[templates[0].Id] = "job_template"
+		templateFields[templates[0].Id] = configuration.Job_template.Custom_fields
+	}
+	for i, template := range configuration.Job_templates {
+		templatePaths[template.Id] = fmt.Sprintf("job_templates[%d]", i)
+		templateFields[template.Id] = template.Custom_fields
+	}
+
+	for _, jobTemplate := range templates {
+		templatePath := templatePaths[jobTemplate.Id]
+		var templateErrs configErrors
+		add := func(key string, message string) {
+			templateErrs = append(templateErrs, configError{Path: joinConfigPath(templatePath, key), Message: message})
+		}
+
+		if jobTemplate.Project == nil || jobTemplate.Project.Id <= 0 {
+			add("project.id", "a project id is required")
+		}
+
+		if jobTemplate.Source == "" {
+			add("source", "a source is required")
+		} else if _, err := os.Stat(jobTemplate.Source); err != nil {
+			add("source", "source file doesn't exist: "+jobTemplate.Source)
+		}
+
+		if jobTemplate.Source_language == "" {
+			add("source_language", "a source language is required")
+		} else if !languageTagPattern.MatchString(jobTemplate.Source_language) {
+			add("source_language", "\""+jobTemplate.Source_language+"\" is not a language tag like en-US")
+		}
+
+		if len(jobTemplate.Target_languages) == 0 {
+			add("target_languages", "at least one target language is required")
+		}
+		for i, language := range jobTemplate.Target_languages {
+			if !languageTagPattern.MatchString(language) {
+				add(fmt.Sprintf("target_languages[%d]", i), "\""+language+"\" is not a language tag like de-DE")
+			}
+		}
+
+		for key, text := range map[string]string{"name": jobTemplate.Name, "description": jobTemplate.Description} {
+			if _, err := template.New(key).Parse(text); err != nil {
+				add(key, err.Error())
+			}
+		}
+
+		// Custom field values can only be checked with a working date context
+		datesValid := true
+		if jobTemplate.Timezone != "" {
+			if _, err := time.LoadLocation(jobTemplate.Timezone); err != nil {
+				add("timezone", "unknown timezone \""+jobTemplate.Timezone+"\"")
+				datesValid = false
+			}
+		}
+		if jobTemplate.Holiday_calendar != "" {
+			if _, err := readHolidayCalendar(jobTemplate.Holiday_calendar); err != nil {
+				add("holiday_calendar", err.Error())
+				datesValid = false
+			}
+		}
+		if jobTemplate.App_version_file != "" {
+			if _, err := os.Stat(jobTemplate.App_version_file); err != nil {
+				add("app_version_file", "file doesn't exist: "+jobTemplate.App_version_file)
+			}
+		}
+
+		pruning := jobTemplate.Custom_field_pruning
+		if pruning != "" && pruning != PruneDelete && pruning != PruneBlank {
+			add("custom_field_pruning", "must be \""+string(PruneDelete)+"\" or \""+string(PruneBlank)+"\"")
+		}
+
+		defaults := jobTemplate.Custom_field_defaults
+		if err := validateCustomFieldPermission("internal permission", defaults.Internal_permission); err != nil {
+			add("custom_field_defaults.internal_permission", err.Error())
+		}
+		if err := validateCustomFieldPermission("external permission", defaults.External_permission); err != nil {
+			add("custom_field_defaults.external_permission", err.Error())
+		}
+
+		for _, fieldConfig := range jobTemplate.Custom_fields {
+			// Inherited fields are reported where they are written, the keys of
+			// the template's own ones where they are
+			fieldPath := "custom_fields"
+			inherited := true
+			for i, own := range templateFields[jobTemplate.Id] {
+				if own.Name == fieldConfig.Name {
+					fieldPath = fmt.Sprintf("custom_fields[%d]", i)
+					inherited = false
+				}
+			}
+			addField := func(key string, message string) {
+				if inherited {
+					key = ""
+				}
+				add(joinConfigPath(fieldPath, key), message)
+			}
+
+			if fieldConfig.Name == "" {
+				addField("name", "a custom field name is required")
+				continue
+			}
+			knownType := true
+			switch fieldConfig.Type {
+			case "", Text, Number, DateTime, Choices, ChoicesMultiple, TextArea, Checkbox:
+			default:
+				addField("type", "unknown custom field type \""+string(fieldConfig.Type)+"\"")
+				knownType = false
+			}
+			var languages []string
+			for language := range fieldConfig.Values_by_language {
+				languages = append(languages, language)
+			}
+			sort.Strings(languages)
+			for _, language := range languages {
+				if !languageTagPattern.MatchString(language) {
+					addField("values_by_language."+language, "\""+language+"\" is not a language tag like de-DE")
+				}
+			}
+
+			// Values can't be checked against an unknown type
+			if !datesValid || !knownType {
+				continue
+			}
+			single := jobTemplate
+			single.Custom_fields = []MoraviaJobCustomFieldConfiguration{fieldConfig}
+			single.Custom_field_defaults = MoraviaCustomFieldDefaultsConfiguration{}
+			if _, err := jobCustomFieldsFromTemplate(single, Job{}); err != nil {
+				fieldErrs, ok := err.(multiError)
+				if !ok {
+					fieldErrs = multiError{err}
+				}
+				for _, fieldErr := range fieldErrs {
+					key := ""
+					if fieldErr, ok := fieldErr.(customFieldError); ok {
+						key = fieldErr.Key
+					}
+					addField(key, fieldErr.Error())
+				}
+			}
+		}
+
+		sort.SliceStable(templateErrs, func(i, j int) bool { return templateErrs[i].Path < templateErrs[j].Path })
+		errs = append(errs, templateErrs...)
+	}
+
+	return errs.locate(file, positions)
+}
+
+// config command: lint checks a configuration file without submitting anything,
+// schema prints the JSON Schema for it or checks a committed copy is current
+func runConfigCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: config lint [file] | config schema [-check file]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "lint":
+		file := getenv("moravia_config", "moravia.yml")
+		if len(args) > 1 {
+			file = args[1]
+		}
+
+		// Every environment is checked. Errors only some environments have say which.
+		// Undefined variables are warnings, so it works without CI's secrets.
+		var messages []string
+		environmentsByMessage := make(map[string][]string)
+		invalid := false
+		for _, environment := range moraviaEnvironments {
+			var configuration MoraviaConfiguration
+			errs := configuration.readAndValidate(file, environment, true)
+			for _, err := range errs {
+				message := err.Error()
+				if err.Warning {
+					message = "warning: " + message
+				} else {
+					invalid = true
+				}
+				if environmentsByMessage[message] == nil {
+					messages = append(messages, message)
+				}
+				environmentsByMessage[message] = append(environmentsByMessage[message], environment)
+			}
+		}
+		for _, message := range messages {
+			if environments := environmentsByMessage[message]; len(environments) < len(moraviaEnvironments) {
+				message = "[" + strings.Join(environments, ", ") + "] " + message
+			}
+			fmt.Println(message)
+		}
+		if invalid {
+			os.Exit(1)
+		}
+		fmt.Println(file + " is valid")
+	case "schema":
+		flags := flag.NewFlagSet("config schema", flag.ExitOnError)
+		check := flags.String("check", "", "exit with an error if this schema file isn't current")
+		flags.Parse(args[1:])
+
+		if *check != "" {
+			committed, err := ioutil.ReadFile(*check)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !isConfigurationSchemaCurrent(committed) {
+				fmt.Println(*check + " is out of date, regenerate it with: config schema > " + *check)
+				os.Exit(1)
+			}
+			fmt.Println(*check + " is current")
+			return
+		}
+
+		schema, err := configurationSchemaJSON()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(schema)
+	default:
+		fmt.Println("Unknown config command \"" + args[0] + "\". Commands: lint, schema")
+		os.Exit(2)
+	}
+}
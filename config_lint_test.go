@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const lintTemplate = `job_template:
+  source: %s
+  source_language: en-US
+  target_languages: [de-DE, fr-FR]
+  custom_fields:
+%s`
+
+func TestReadAndValidateReportsEveryError(t *testing.T) {
+	tests := []struct {
+		name     string
+		project  string
+		fields   string
+		expected []string // path at line:column
+	}{
+		{
+			name:     "valid",
+			project:  "id: 1",
+			fields:   "    - name: Platform\n      value: [iOS]\n",
+			expected: nil,
+		},
+		{
+			name:    "a type error doesn't hide the checks after it",
+			project: "id: abc",
+			fields:  "    - name: Platform\n      type: Choices\n      choices: [iOS]\n      value: [Windows]\n",
+			expected: []string{
+				"project.id at 2:3",
+				"job_template.custom_fields[0].value at 11:7",
+			},
+		},
+		{
+			name:    "every error of a field",
+			project: "id: 1",
+			fields:  "    - name: Priority\n      type: Number\n      value: [high]\n      internal_permission: Sometimes\n",
+			expected: []string{
+				"job_template.custom_fields[0].value at 10:7",
+				"job_template.custom_fields[0].internal_permission at 11:7",
+			},
+		},
+		{
+			name:    "every language of a field",
+			project: "id: 1",
+			fields: "    - name: Reviewer\n      type: Checkbox\n      is_language_specific: true\n      values_by_language:\n" +
+				"        de-DE: [maybe]\n        ja-JP: [yes]\n        fr-FR: [yes, no]\n",
+			expected: []string{
+				"job_template.custom_fields[0].values_by_language.de-DE at 12:9",
+				"job_template.custom_fields[0].values_by_language.ja-JP at 13:9",
+				"job_template.custom_fields[0].values_by_language.fr-FR at 14:9",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source := filepath.Join(dir, "en.xliff")
+			file := filepath.Join(dir, "moravia.yml")
+			contents := "project:\n  " + test.project + "\n" + fmt.Sprintf(lintTemplate, source, test.fields)
+			if err := ioutil.WriteFile(source, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var configuration MoraviaConfiguration
+			var reported []string
+			for _, err := range configuration.readAndValidate(file, "test", true) {
+				reported = append(reported, fmt.Sprintf("%s at %d:%d", err.Path, err.Line, err.Column))
+			}
+			if !reflect.DeepEqual(reported, test.expected) {
+				t.Errorf("expected %q, got %q", test.expected, reported)
+			}
+		})
+	}
+}
+
+func TestLocateYAMLPaths(t *testing.T) {
+	document := `job_defaults: &defaults
+  source_language: en-US
+  custom_fields: &fields
+    - &platform name: Platform
+      value: [iOS]
+job_templates:
+  - id: app   
+    <<: *defaults
+    project: {id: 1, "name": x}
+    target_languages: [de-DE, "fr, FR", 'it-IT']
+    custom_fields:
+      - {name: Reviewer, values_by_language: {de-DE: [Anna, Bob]}}
+  - id: web # a comment
+    custom_fields: *fields
+    description: |
+      name: not a key
+    dates:
+      "release date": 2026-11-20
+      'qa: start': 2026-11-01
+`
+	positions := locateYAMLPaths(document)
+
+	tests := []struct {
+		path     string
+		expected string // line:column, "" if it isn't found
+	}{
+		{"job_defaults", "1:1"},
+		{"job_defaults.source_language", "2:3"},
+		{"job_defaults.custom_fields[0]", "4:5"},
+		{"job_defaults.custom_fields[0].name", "4:7"},
+		{"job_defaults.custom_fields[0].value", "5:7"},
+		{"job_defaults.custom_fields[0].value[0]", "5:15"},
+		{"job_templates[0].id", "7:5"},
+
+		// Flow style
+		{"job_templates[0].project.id", "9:15"},
+		{"job_templates[0].project.name", "9:22"},
+		{"job_templates[0].target_languages[0]", "10:24"},
+		{"job_templates[0].target_languages[1]", "10:31"},
+		{"job_templates[0].target_languages[2]", "10:41"},
+		{"job_templates[0].target_languages[3]", "10:5"},
+		{"job_templates[0].custom_fields[0]", "12:7"},
+		{"job_templates[0].custom_fields[0].name", "12:10"},
+		{"job_templates[0].custom_fields[0].values_by_language.de-DE", "12:47"},
+		{"job_templates[0].custom_fields[0].values_by_language.de-DE[1]", "12:61"},
+
+		// Values from a merge key are at the merge key, aliased ones at the alias
+		{"job_templates[0].source_language", "8:5"},
+		{"job_templates[1].custom_fields[0].value", "14:5"},
+
+		{"job_templates[1].id", "13:5"},
+		{"job_templates[1].description.name", "15:5"},
+		{"job_templates[1].dates.release date", "18:7"},
+		{"job_templates[1].dates.qa: start", "19:7"},
+		{"project.id", ""},
+	}
+	for _, test := range tests {
+		position, ok := positions.find(test.path)
+		found := ""
+		if ok {
+			found = fmt.Sprintf("%d:%d", position.Line, position.Column)
+		}
+		if found != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.path, test.expected, found)
+		}
+	}
+}
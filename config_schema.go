@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const configurationSchemaId = "https://github.com/ChargePoint/bitrise-step-moravia/moravia.schema.json"
+
+// Allowed values of the configuration's string enums
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeOf(CustomFieldType("")):       {string(Text), string(Number), string(DateTime), string(Choices), string(ChoicesMultiple), string(TextArea), string(Checkbox)},
+	reflect.TypeOf(CustomFieldPermission("")): {string(None), string(Read), string(Edit)},
+	reflect.TypeOf(CustomFieldPruning("")):    {string(PruneDelete), string(PruneBlank)},
+}
+
+// Shown by editors, keyed by type name and yaml key
+var schemaDescriptions = map[string]string{
+	"MoraviaConfiguration.project":       "The Moravia project jobs are created in",
+	"MoraviaConfiguration.job_template":  "A single job template, with the id \"default\"",
+	"MoraviaConfiguration.job_defaults":  "Inherited by every job template",
+	"MoraviaConfiguration.job_templates": "Named job templates, picked with the moravia_template input",
+
+	"MoraviaProjectConfiguration.id": "Moravia project ID",
+
+	"MoraviaJobTemplateConfiguration.id":                      "Selects the template with moravia_template and extends",
+	"MoraviaJobTemplateConfiguration.extends":                 "Id of a template to inherit from",
+	"MoraviaJobTemplateConfiguration.project":                 "Overrides the configuration project",
+	"MoraviaJobTemplateConfiguration.name":                    "Job name, a Go text/template with .Date, .Branch, .Commit, .ShortCommit, .Tag, .BuildNumber, .AppVersion and .ChangedStrings",
+	"MoraviaJobTemplateConfiguration.description":             "Job description, a Go text/template with the same variables as name",
+	"MoraviaJobTemplateConfiguration.source":                  "File uploaded as the job source",
+	"MoraviaJobTemplateConfiguration.source_language":         "Language tag of the source, e.g. en-US",
+	"MoraviaJobTemplateConfiguration.target_languages":        "Language tags to translate into, e.g. de-DE",
+	"MoraviaJobTemplateConfiguration.custom_fields":           "Job custom fields, merged by name with inherited ones",
+	"MoraviaJobTemplateConfiguration.custom_field_defaults":   "Group and permissions for custom fields that don't set their own",
+	"MoraviaJobTemplateConfiguration.dates":                   "Named dates for DateTime expressions, e.g. release_date: 2019-11-20",
+	"MoraviaJobTemplateConfiguration.holiday_calendar":        "File with one 2006-01-02 date per line, skipped by business day offsets",
+	"MoraviaJobTemplateConfiguration.timezone":                "IANA timezone for dates, e.g. Europe/Prague",
+	"MoraviaJobTemplateConfiguration.app_version_file":        "Info.plist or build.gradle to read .AppVersion from",
+	"MoraviaJobTemplateConfiguration.changed_strings_since":   "Git revision .ChangedStrings compares against, HEAD~1 by default",
+	"MoraviaJobTemplateConfiguration.custom_field_pruning":    "Delete or blank job custom fields that aren't configured",
+	"MoraviaJobTemplateConfiguration.protected_custom_fields": "Custom fields pruning never touches",
+	"MoraviaJobTemplateConfiguration.failure_custom_field":    "Custom field set on a failed job if it can't be deleted, Automation Error by default",
+
+	"MoraviaJobCustomFieldConfiguration.name":                 "Custom field name",
+	"MoraviaJobCustomFieldConfiguration.group":                "Group the field is shown under",
+	"MoraviaJobCustomFieldConfiguration.type":                 "Custom field type",
+	"MoraviaJobCustomFieldConfiguration.choices":              "Allowed values of Choices and ChoicesMultiple fields",
+	"MoraviaJobCustomFieldConfiguration.is_language_specific": "One value per target language",
+	"MoraviaJobCustomFieldConfiguration.is_required":          "Fail if there is no value, or no value for a target language",
+	"MoraviaJobCustomFieldConfiguration.value":                "Value, or default value for language specific fields. DateTime values may be expressions like \"+5 business days\"",
+	"MoraviaJobCustomFieldConfiguration.values_by_language":   "Values of a language specific field by target language",
+	"MoraviaJobCustomFieldConfiguration.internal_permission":  "Permission for internal users",
+	"MoraviaJobCustomFieldConfiguration.external_permission":  "Permission for external users, e.g. vendors",
+}
+
+// Language tag keys and values
+var schemaLanguageTagKeys = map[string]bool{
+	"MoraviaJobTemplateConfiguration.source_language":       true,
+	"MoraviaJobTemplateConfiguration.target_languages":      true,
+	"MoraviaJobCustomFieldConfiguration.values_by_language": true,
+}
+
+// ${VAR} or ${VAR:-default}, accepted wherever a number, boolean or enum is
+var schemaInterpolation = map[string]interface{}{
+	"type":    "string",
+	"pattern": `^\$\{[A-Za-z_][A-Za-z0-9_]*(:-[^}]*)?\}$`,
+}
+
+// Generates a JSON Schema (draft-07) for moravia.yml from the configuration types
+func configurationSchema() map[string]interface{} {
+	definitions := make(map[string]interface{})
+	root := schemaForType(reflect.TypeOf(MoraviaConfiguration{}), "", definitions)
+
+	schema := map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"$id":         configurationSchemaId,
+		"title":       "Moravia step configuration",
+		"definitions": definitions,
+	}
+	for key, value := range root {
+		schema[key] = value
+	}
+
+	// Overlays are taken out before decoding, so they aren't a configuration field
+	environments := make(map[string]interface{})
+	for _, environment := range moraviaEnvironments {
+		environments[environment] = map[string]interface{}{
+			"allOf":       []interface{}{map[string]interface{}{"$ref": "#"}},
+			"description": "Merged over the configuration in " + environment,
+		}
+	}
+	root["properties"].(map[string]interface{})["environments"] = map[string]interface{}{
+		"type":                 "object",
+		"description":          "Overlays for the test and production environments, picked by moravia_production",
+		"properties":           environments,
+		"additionalProperties": false,
+	}
+	return schema
+}
+
+func configurationSchemaJSON() ([]byte, error) {
+	out, err := json.MarshalIndent(configurationSchema(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// key is "Type.yaml_key" of the field being described, if any
+func schemaForType(t reflect.Type, key string, definitions map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var schema map[string]interface{}
+	switch t.Kind() {
+	case reflect.Struct:
+		if t != reflect.TypeOf(MoraviaConfiguration{}) {
+			if _, defined := definitions[t.Name()]; !defined {
+				definitions[t.Name()] = nil // Placeholder for recursive types
+				definitions[t.Name()] = schemaForStruct(t, definitions)
+			}
+			schema = map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+		} else {
+			schema = schemaForStruct(t, definitions)
+		}
+	case reflect.Slice:
+		items := schemaForType(t.Elem(), "", definitions)
+		if schemaLanguageTagKeys[key] {
+			items["pattern"] = languageTagPattern.String()
+		}
+		schema = map[string]interface{}{"type": "array", "items": items}
+	case reflect.Map:
+		schema = map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaForType(t.Elem(), "", definitions),
+		}
+		if schemaLanguageTagKeys[key] {
+			schema["propertyNames"] = map[string]interface{}{"pattern": languageTagPattern.String()}
+		}
+	case reflect.Int:
+		schema = map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "integer"}, schemaInterpolation}}
+	case reflect.Bool:
+		schema = map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "boolean"}, schemaInterpolation}}
+	default:
+		schema = map[string]interface{}{"type": "string"}
+		if values, ok := schemaEnums[t]; ok {
+			schema = map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "string", "enum": values}, schemaInterpolation}}
+		} else if schemaLanguageTagKeys[key] {
+			schema["pattern"] = languageTagPattern.String()
+		} else {
+			// Unquoted numbers and booleans decode into strings too
+			schema["type"] = []string{"string", "number", "boolean"}
+		}
+	}
+
+	if description, ok := schemaDescriptions[key]; ok {
+		if _, isRef := schema["$ref"]; isRef {
+			// Siblings of $ref are ignored in draft-07
+			schema = map[string]interface{}{"allOf": []interface{}{schema}}
+		}
+		schema["description"] = description
+	}
+	return schema
+}
+
+func schemaForStruct(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	fields := yamlFields(t)
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		properties[name] = schemaForType(fields[name].Type, t.Name()+"."+name, definitions)
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+func isConfigurationSchemaCurrent(committed []byte) bool {
+	generated, err := configurationSchemaJSON()
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(generated)) == strings.TrimSpace(string(committed))
+}
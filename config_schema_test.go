@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestConfigurationSchemaIsCurrent(t *testing.T) {
+	committed, err := ioutil.ReadFile("moravia.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := configurationSchemaJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(generated)) != strings.TrimSpace(string(committed)) {
+		t.Error("moravia.schema.json is out of date, regenerate it with: go run . config schema > moravia.schema.json")
+	}
+}
+
+func TestConfigurationSchemaAcceptsInterpolatedEnums(t *testing.T) {
+	definitions := configurationSchema()["definitions"].(map[string]interface{})
+	fields := definitions["MoraviaJobCustomFieldConfiguration"].(map[string]interface{})["properties"].(map[string]interface{})
+	for _, key := range []string{"type", "internal_permission", "external_permission"} {
+		anyOf, ok := fields[key].(map[string]interface{})["anyOf"].([]interface{})
+		if !ok || len(anyOf) != 2 {
+			t.Errorf("%s: expected an enum or an interpolation, got %v", key, fields[key])
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type MoraviaProjectConfiguration struct {
+	Id int `yaml:"id"`
+}
+
+type MoraviaJobCustomFieldConfiguration struct {
+	Group                string              `yaml:"group"`
+	Name                 string              `yaml:"name"`
+	Type                 CustomFieldType     `yaml:"type"`
+	Choices              []string            `yaml:"choices"`
+	Is_language_specific bool                `yaml:"is_language_specific"`
+	Is_required          bool                `yaml:"is_required"`
+	Value                []string            `yaml:"value"`
+	Values_by_language   map[string][]string `yaml:"values_by_language"`
+
+	// Default to the template's custom_field_defaults, then Edit
+	Internal_permission CustomFieldPermission `yaml:"internal_permission"`
+	External_permission CustomFieldPermission `yaml:"external_permission"`
+}
+
+// Applied to every custom field of a template that doesn't set its own
+type MoraviaCustomFieldDefaultsConfiguration struct {
+	Group               string                `yaml:"group"`
+	Internal_permission CustomFieldPermission `yaml:"internal_permission"`
+	External_permission CustomFieldPermission `yaml:"external_permission"`
+}
+
+type MoraviaJobTemplateConfiguration struct {
+	Id      string                       `yaml:"id"`      // For moravia_template and extends
+	Extends string                       `yaml:"extends"` // Id of a template to inherit from
+	Project *MoraviaProjectConfiguration `yaml:"project"` // Overrides the configuration project
+
+	Name             string                               `yaml:"name"`        // Go text/template, see jobTextData
+	Description      string                               `yaml:"description"` // Go text/template, see jobTextData
+	Source           string                               `yaml:"source"`
+	Source_language  string                               `yaml:"source_language"`
+	Target_languages []string                             `yaml:"target_languages"`
+	Custom_fields    []MoraviaJobCustomFieldConfiguration `yaml:"custom_fields"`
+
+	Custom_field_defaults MoraviaCustomFieldDefaultsConfiguration `yaml:"custom_field_defaults"`
+
+	// For DateTime custom field expressions like "release_date - 3d" or "+5 business days"
+	Dates            map[string]string `yaml:"dates"`
+	Holiday_calendar string            `yaml:"holiday_calendar"`
+	Timezone         string            `yaml:"timezone"`
+
+	// For the name and description templates
+	App_version_file      string `yaml:"app_version_file"`      // Info.plist or build.gradle
+	Changed_strings_since string `yaml:"changed_strings_since"` // Git revision, HEAD~1 by default
+
+	// Opt-in removal of job custom fields that aren't in custom_fields: "delete" or "blank"
+	Custom_field_pruning    CustomFieldPruning `yaml:"custom_field_pruning"`
+	Protected_custom_fields []string           `yaml:"protected_custom_fields"`
+
+	// Set on a failed job that can't be deleted, "Automation Error" by default
+	Failure_custom_field string `yaml:"failure_custom_field"`
+}
+
+type MoraviaConfiguration struct {
+	Project      MoraviaProjectConfiguration     `yaml:"project"`
+	Job_template MoraviaJobTemplateConfiguration `yaml:"job_template"` // A single template, with id "default"
+
+	// Every template inherits job_defaults, then whatever it extends
+	Job_defaults  MoraviaJobTemplateConfiguration   `yaml:"job_defaults"`
+	Job_templates []MoraviaJobTemplateConfiguration `yaml:"job_templates"`
+}
+
+// The overlay for environment is merged over the file first, see
+// applyEnvironmentOverlays. Environment variables are then interpolated into
+// every string value, so "${MORAVIA_PROJECT_ID}" or "${REVIEWER:-nobody}" work
+// anywhere. Decoding is strict: unknown keys and values of the wrong type are
+// errors, reported with their line and column. They're left out of the
+// configuration, so the rest of it can still be validated.
+//
+// With lint, undefined variables are warnings instead, for checking the file
+// without CI's secrets. Values that are only an undefined variable aren't type
+// checked and are left out, see unresolvedVariable.
+func (config *MoraviaConfiguration) readFromFile(filepath string, environment string, lint bool) (yamlPositions, configErrors) {
+	yamlFile, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, configErrors{{File: filepath, Message: err.Error()}}
+	}
+	positions := locateYAMLPaths(string(yamlFile))
+
+	var tree interface{}
+	err = yaml.Unmarshal(yamlFile, &tree)
+	if err != nil {
+		// yaml errors carry their own line numbers
+		return positions, configErrors{{File: filepath, Message: err.Error()}}
+	}
+
+	tree, errs := applyEnvironmentOverlays(tree, filepath, environment, positions)
+	tree, interpolationErrs := interpolateEnvironment(tree, os.LookupEnv, lint)
+	errs = append(errs, interpolationErrs...)
+	errs = append(errs, checkConfigurationTree(tree, reflect.TypeOf(*config), "")...)
+	tree = dropUnresolvedVariables(tree)
+
+	// What's left decodes, errors and all, so it can still be validated
+	interpolated, err := yaml.Marshal(tree)
+	if err != nil {
+		return positions, configErrors{{File: filepath, Message: err.Error()}}
+	}
+	err = yaml.UnmarshalStrict(interpolated, config)
+	if err != nil {
+		return positions, append(errs, configError{File: filepath, Message: err.Error()}).locate(filepath, positions)
+	}
+
+	return positions, errs.locate(filepath, positions)
+}
+
+// Reads the file, see readFromFile, and validates what could be read. Every
+// error is returned, in file order.
+func (config *MoraviaConfiguration) readAndValidate(filepath string, environment string, lint bool) configErrors {
+	positions, errs := config.readFromFile(filepath, environment, lint)
+	if !errs.decoded() {
+		return errs
+	}
+	errs = append(errs, validateConfiguration(*config, filepath, positions).withoutDropped(errs)...)
+	return errs.locate(filepath, positions)
+}
+
+// Reads and validates moravia_config for the moravia_production environment, exiting with every error found if it isn't valid
+func loadConfiguration() MoraviaConfiguration {
+	moraviaConfigFilepath := getenv("moravia_config", "moravia.yml")
+
+	var configuration MoraviaConfiguration
+	errs := configuration.readAndValidate(moraviaConfigFilepath, moraviaEnvironment(), false)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			logs.Error(err.Error())
+		}
+		os.Exit(1)
+	}
+
+	return configuration
+}
+
+// The templates picked by moravia_template, resolved
+func loadJobTemplates(configuration MoraviaConfiguration) []MoraviaJobTemplateConfiguration {
+	templates, err := resolveJobTemplates(configuration)
+	if err != nil {
+		logs.Fatal(err.Error())
+	}
+
+	templates, err = selectJobTemplates(templates, getenv("moravia_template", "all"))
+	if err != nil {
+		logs.Fatal(err.Error())
+	}
+
+	if len(templates) == 0 {
+		logs.Fatal("A job template is required")
+	}
+
+	return templates
+}
+
+var interpolationPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Replaces ${VAR} and ${VAR:-default} in the string values of a decoded YAML
+// tree. $$ is a literal $. Variables without a default must be set, with lint
+// they're warnings. Values that come from secret variables are registered so
+// they're masked in logs.
+func interpolateEnvironment(tree interface{}, lookup func(string) (string, bool), lint bool) (interface{}, configErrors) {
+	var errs configErrors
+
+	var interpolate func(node interface{}, path string) interface{}
+	interpolate = func(node interface{}, path string) interface{} {
+		switch value := node.(type) {
+		case string:
+			undefined := false
+			interpolated := interpolationPattern.ReplaceAllStringFunc(value, func(match string) string {
+				if match == "$$" {
+					return "$"
+				}
+				groups := interpolationPattern.FindStringSubmatch(match)
+				name, hasDefault, fallback := groups[1], groups[2] != "", groups[3]
+
+				variable, ok := lookup(name)
+				if !ok || (hasDefault && variable == "") {
+					if !hasDefault {
+						errs = append(errs, configError{Path: path, Message: "undefined environment variable " + name, Warning: lint})
+						undefined = true
+						return match
+					}
+					return fallback
+				}
+				if isSecretEnvironmentVariable(name) {
+					registerSecret(variable)
+				}
+				return variable
+			})
+			if undefined && lint && interpolationPattern.FindString(value) == value {
+				return unresolvedVariable(value)
+			}
+			if interpolated != value && interpolationPattern.FindString(value) == value {
+				return resolveInterpolatedScalar(interpolated)
+			}
+			return interpolated
+		case map[interface{}]interface{}:
+			for key, child := range value {
+				value[key] = interpolate(child, joinConfigPath(path, fmt.Sprint(key)))
+			}
+			return value
+		case []interface{}:
+			for i, child := range value {
+				value[i] = interpolate(child, fmt.Sprintf("%s[%d]", path, i))
+			}
+			return value
+		default:
+			return node
+		}
+	}
+	tree = interpolate(tree, "")
+
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+	return tree, errs
+}
+
+// A value that's only an undefined variable, when linting. Its type can't be
+// checked, and it's dropped before decoding.
+type unresolvedVariable string
+
+func dropUnresolvedVariables(node interface{}) interface{} {
+	switch value := node.(type) {
+	case map[interface{}]interface{}:
+		for key, child := range value {
+			if _, unresolved := child.(unresolvedVariable); unresolved {
+				delete(value, key)
+				continue
+			}
+			value[key] = dropUnresolvedVariables(child)
+		}
+	case []interface{}:
+		var kept []interface{}
+		for _, child := range value {
+			if _, unresolved := child.(unresolvedVariable); !unresolved {
+				kept = append(kept, dropUnresolvedVariables(child))
+			}
+		}
+		return kept
+	}
+	return node
+}
+
+// A value that was only a variable reference, like id: ${MORAVIA_PROJECT_ID},
+// takes the type of its contents so it can decode into ints and bools. Values
+// that wouldn't survive the round trip, like 0123, stay strings.
+func resolveInterpolatedScalar(value string) interface{} {
+	var resolved interface{}
+	if err := yaml.Unmarshal([]byte(value), &resolved); err != nil {
+		return value
+	}
+	switch resolved.(type) {
+	case int, int64, uint64, float64, bool:
+		marshaled, err := yaml.Marshal(resolved)
+		if err == nil && strings.TrimSpace(string(marshaled)) == value {
+			return resolved
+		}
+	}
+	return value
+}
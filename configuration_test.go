@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInterpolateEnvironment(t *testing.T) {
+	environment := map[string]string{
+		"NAME":    "iOS",
+		"EMPTY":   "",
+		"PROJECT": "12",
+		"FLAG":    "true",
+		"ZIP":     "0123",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := environment[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		name     string
+		value    string
+		lint     bool
+		expected interface{}
+		err      string // The message, "warning: " first for a warning
+	}{
+		{name: "variable", value: "${NAME}", expected: "iOS"},
+		{name: "in text", value: "Build for ${NAME}, ${NAME}!", expected: "Build for iOS, iOS!"},
+		{name: "default", value: "${MISSING:-nobody}", expected: "nobody"},
+		{name: "default with spaces", value: "${MISSING:-QA team}", expected: "QA team"},
+		{name: "default for an empty variable", value: "${EMPTY:-nobody}", expected: "nobody"},
+		{name: "empty default", value: "${MISSING:-}", expected: ""},
+		{name: "empty variable", value: "${EMPTY}", expected: ""},
+		{name: "escaped", value: "$${NAME} costs $$5", expected: "${NAME} costs $5"},
+		{name: "not a variable", value: "$NAME and ${1X}", expected: "$NAME and ${1X}"},
+		{name: "whole number", value: "${PROJECT}", expected: 12},
+		{name: "bool", value: "${FLAG}", expected: true},
+		{name: "number that isn't one", value: "${ZIP}", expected: "0123"},
+		{name: "number in text", value: "job-${PROJECT}", expected: "job-12"},
+		{name: "undefined", value: "${MISSING}", expected: "${MISSING}", err: "undefined environment variable MISSING"},
+		{name: "undefined when linting", value: "${MISSING}", lint: true, expected: unresolvedVariable("${MISSING}"), err: "warning: undefined environment variable MISSING"},
+		{name: "undefined in text when linting", value: "for ${MISSING}", lint: true, expected: "for ${MISSING}", err: "warning: undefined environment variable MISSING"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree := map[interface{}]interface{}{"key": test.value}
+			interpolated, errs := interpolateEnvironment(tree, lookup, test.lint)
+
+			if value := interpolated.(map[interface{}]interface{})["key"]; !reflect.DeepEqual(value, test.expected) {
+				t.Errorf("expected %#v, got %#v", test.expected, value)
+			}
+			var messages []string
+			for _, err := range errs {
+				message := err.Message
+				if err.Warning {
+					message = "warning: " + message
+				}
+				if err.Path != "key" {
+					t.Errorf("expected the error at key, got %s", err.Path)
+				}
+				messages = append(messages, message)
+			}
+			var expected []string
+			if test.err != "" {
+				expected = []string{test.err}
+			}
+			if !reflect.DeepEqual(messages, expected) {
+				t.Errorf("expected errors %q, got %q", expected, messages)
+			}
+		})
+	}
+}
+
+func TestInterpolateEnvironmentMasksSecrets(t *testing.T) {
+	t.Setenv("moravia_secret_env_vars", "REVIEWER_EMAIL")
+	environment := map[string]string{
+		"MORAVIA_API_KEY": "key-1234567",
+		"db_password":     "hunter22",
+		"REVIEWER_EMAIL":  "anna@example.com",
+		"SHORT_TOKEN":     "abc",
+		"APP_NAME":        "Acme App",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := environment[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		name     string
+		variable string
+		expected string // What the value is logged as
+	}{
+		{name: "secret by name", variable: "MORAVIA_API_KEY", expected: maskedSecret},
+		{name: "secret by name, any case", variable: "db_password", expected: maskedSecret},
+		{name: "listed as secret", variable: "REVIEWER_EMAIL", expected: maskedSecret},
+		{name: "too short to mask", variable: "SHORT_TOKEN", expected: "abc"},
+		{name: "not secret", variable: "APP_NAME", expected: "Acme App"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree := map[interface{}]interface{}{"description": "Reviewer: ${" + test.variable + "}"}
+			interpolated, errs := interpolateEnvironment(tree, lookup, false)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+
+			// The configuration keeps the value, logs don't
+			value := interpolated.(map[interface{}]interface{})["description"].(string)
+			if value != "Reviewer: "+environment[test.variable] {
+				t.Errorf("expected the value in the configuration, got %q", value)
+			}
+			if masked := maskSecrets(value); masked != "Reviewer: "+test.expected {
+				t.Errorf("expected %q to be logged, got %q", "Reviewer: "+test.expected, masked)
+			}
+		})
+	}
+}
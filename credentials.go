@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Set with the -profile flag, overrides MORAVIA_PROFILE
+var credentialsProfile string
+
+type moraviaCredentials struct {
+	ClientID       string
+	ClientSecret   string
+	ServiceAccount string
+}
+
+// MORAVIA_CREDENTIALS_FILE, or ~/.config/moravia/credentials
+func credentialsFilePath() string {
+	if path := getenv("MORAVIA_CREDENTIALS_FILE", ""); path != "" {
+		return path
+	}
+	configDir := getenv("XDG_CONFIG_HOME", "")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configDir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configDir, "moravia", "credentials")
+}
+
+// Reads an INI style credentials file for local use:
+//
+//	[default]
+//	client_id = ...
+//	client_secret = ...
+//	service_account = ...
+//
+//	[default.production]
+//	client_id = ...
+//
+// A profile can have a section per environment, [name.production] or
+// [name.test], which is used over [name] in that environment.
+func readCredentialsFile(path string) (map[string]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s can be read by other users (%s), run: chmod 600 %s", path, info.Mode().Perm(), path)
+	}
+
+	sections := make(map[string]map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if sections[section] == nil {
+				sections[section] = make(map[string]string)
+			}
+			continue
+		}
+		equals := strings.Index(line, "=")
+		if equals < 0 || section == "" {
+			return nil, fmt.Errorf("%s:%d: expected [profile] or key = value", path, lineNumber)
+		}
+		key := strings.TrimSpace(line[:equals])
+		value := strings.Trim(strings.TrimSpace(line[equals+1:]), "\"'")
+		sections[section][key] = value
+	}
+	return sections, scanner.Err()
+}
+
+// The credentials of the selected profile. A missing file is only an error if a
+// profile was asked for.
+func loadCredentialsProfile(environment string) (moraviaCredentials, error) {
+	credentials := moraviaCredentials{}
+
+	profile := credentialsProfile
+	if profile == "" {
+		profile = getenv("MORAVIA_PROFILE", "")
+	}
+	explicit := profile != ""
+	if !explicit {
+		profile = "default"
+	}
+
+	path := credentialsFilePath()
+	sections, err := readCredentialsFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return credentials, nil
+	}
+	if err != nil {
+		return credentials, err
+	}
+
+	values, found := sections[profile]
+	environmentValues, foundForEnvironment := sections[profile+"."+environment]
+	if !found && !foundForEnvironment {
+		if !explicit {
+			return credentials, nil
+		}
+		var names []string
+		for name := range sections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return credentials, fmt.Errorf("no profile \"%s\" in %s, it has: %s", profile, path, strings.Join(names, ", "))
+	}
+
+	lookup := func(key string) string {
+		if value, ok := environmentValues[key]; ok {
+			return value
+		}
+		return values[key]
+	}
+	credentials.ClientID = lookup("client_id")
+	credentials.ClientSecret = lookup("client_secret")
+	credentials.ServiceAccount = lookup("service_account")
+	return credentials, nil
+}
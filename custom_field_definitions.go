@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// A custom field as the project defines it, collected from the project's existing jobs
+type CustomFieldDefinition struct {
+	Name                  string
+	Group                 string
+	Formatter             CustomFieldType
+	Choices               []string
+	IsLanguageSpecific    bool
+	InternalPermission    CustomFieldPermission
+	NonInternalPermission CustomFieldPermission
+}
+
+func listJobsForProject(ctx context.Context, auth AuthenticateResponse, projectId int, count int, target interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	url := moraviaJobsURL() + "?$filter=ProjectId%20eq%20" + strconv.Itoa(projectId) + "&$orderby=Id%20desc&$top=" + strconv.Itoa(count)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	authorization_value := "Bearer " + auth.Access_token
+	req.Header.Set("Authorization", authorization_value)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list jobs for project %d: %s", projectId, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+// There is no definitions endpoint, so the definitions are read off the custom
+// fields of the project's most recent jobs
+func listCustomFieldDefinitions(ctx context.Context, auth AuthenticateResponse, projectId int, jobCount int) ([]CustomFieldDefinition, error) {
+	jobs := Jobs{}
+	err := listJobsForProject(ctx, auth, projectId, jobCount, &jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := make(map[string]*CustomFieldDefinition)
+	for _, job := range jobs.Value {
+		customFields := JobCustomFields{}
+		err := listJobCustomFieldsForJob(ctx, auth, job, &customFields)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, field := range customFields.Value {
+			if definitions[field.Name] != nil {
+				continue
+			}
+			definition := CustomFieldDefinition{}
+			definition.Name = field.Name
+			definition.Group = field.Group
+			definition.Formatter = field.DefinitionFormatter
+			if field.DefinitionAdditionalData != "" {
+				for _, choice := range strings.Split(field.DefinitionAdditionalData, ",") {
+					definition.Choices = append(definition.Choices, strings.TrimSpace(choice))
+				}
+			}
+			definition.IsLanguageSpecific = field.IsLanguageSpecific
+			definition.InternalPermission = field.InternalPermission
+			definition.NonInternalPermission = field.NonInternalPermission
+			definitions[field.Name] = &definition
+		}
+	}
+
+	var sorted []CustomFieldDefinition
+	for _, definition := range definitions {
+		sorted = append(sorted, *definition)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Group != sorted[j].Group {
+			return sorted[i].Group < sorted[j].Group
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted, nil
+}
+
+// Compares the configured custom fields with the server definitions. Unknown
+// fields would be created as new ad-hoc fields, so they are reported as warnings.
+func validateCustomFieldsAgainstDefinitions(template MoraviaJobTemplateConfiguration, definitions []CustomFieldDefinition) []string {
+	byName := make(map[string]CustomFieldDefinition)
+	for _, definition := range definitions {
+		byName[definition.Name] = definition
+	}
+
+	var warnings []string
+	for _, fieldConfig := range template.Custom_fields {
+		definition, ok := byName[fieldConfig.Name]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("custom field \"%s\" doesn't exist on the server and would be created", fieldConfig.Name))
+			continue
+		}
+		if fieldConfig.Type != "" && definition.Formatter != "" && fieldConfig.Type != definition.Formatter {
+			warnings = append(warnings, fmt.Sprintf("custom field \"%s\" is %s but the server has %s", fieldConfig.Name, fieldConfig.Type, definition.Formatter))
+		}
+		if fieldConfig.Group != "" && definition.Group != "" && fieldConfig.Group != definition.Group {
+			warnings = append(warnings, fmt.Sprintf("custom field \"%s\" is in group \"%s\" but the server has \"%s\"", fieldConfig.Name, fieldConfig.Group, definition.Group))
+		}
+		if fieldConfig.Is_language_specific != definition.IsLanguageSpecific {
+			warnings = append(warnings, fmt.Sprintf("custom field \"%s\" language specific is %t but the server has %t", fieldConfig.Name, fieldConfig.Is_language_specific, definition.IsLanguageSpecific))
+		}
+		if len(definition.Choices) > 0 {
+			for _, choice := range fieldConfig.Choices {
+				if !containsString(definition.Choices, choice) {
+					warnings = append(warnings, fmt.Sprintf("custom field \"%s\" choice \"%s\" doesn't exist on the server", fieldConfig.Name, choice))
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+func printCustomFieldDefinitions(definitions []CustomFieldDefinition) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tNAME\tTYPE\tLANGUAGE SPECIFIC\tINTERNAL\tEXTERNAL\tCHOICES")
+	for _, definition := range definitions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\t%s\n", definition.Group, definition.Name, definition.Formatter, definition.IsLanguageSpecific, definition.InternalPermission, definition.NonInternalPermission, strings.Join(definition.Choices, ", "))
+	}
+	w.Flush()
+}
+
+// custom-fields command: lists the project's custom field definitions and checks the configuration against them
+func runCustomFieldsCommand(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("custom-fields", flag.ExitOnError)
+	jobCount := flags.Int("jobs", 20, "number of recent project jobs to read definitions from")
+	strict := flags.Bool("strict", false, "exit with an error if the configuration doesn't match the server")
+	flags.Parse(args)
+
+	configuration := loadConfiguration()
+	templates := loadJobTemplates(configuration)
+	auth := authenticateFromEnvironment(ctx)
+
+	projectDefinitions := make(map[int][]CustomFieldDefinition)
+	warningCount := 0
+	for _, template := range templates {
+		definitions, listed := projectDefinitions[template.Project.Id]
+		if !listed {
+			var err error
+			definitions, err = listCustomFieldDefinitions(ctx, auth, template.Project.Id, *jobCount)
+			if err != nil {
+				logs.Fatal("Failed to list custom field definitions for project " + strconv.Itoa(template.Project.Id) + ": " + err.Error())
+			}
+			projectDefinitions[template.Project.Id] = definitions
+
+			fmt.Printf("Project %d\n", template.Project.Id)
+			printCustomFieldDefinitions(definitions)
+		}
+
+		warnings := validateCustomFieldsAgainstDefinitions(template, definitions)
+		for _, warning := range warnings {
+			logs.Warn("job template \"" + template.Id + "\": " + warning)
+		}
+		warningCount += len(warnings)
+	}
+	if *strict && warningCount > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Formats accepted for DateTime custom field values. Values without an offset are in
+// the template timezone. Anything else is evaluated as a date expression.
+var customFieldDateTimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+type CustomFieldPruning string
+
+const (
+	PruneDelete CustomFieldPruning = "delete"
+	PruneBlank  CustomFieldPruning = "blank"
+)
+
+type CustomFieldSyncOptions struct {
+	DryRun      bool               // Compute the change set without creating, updating or pruning anything
+	Prune       CustomFieldPruning // Remove existing fields that aren't in the desired fields
+	PruneJobIds []int              // Jobs to prune even if they have no desired fields
+	Protected   []string           // Field names pruning leaves alone
+}
+
+type CustomFieldChange struct {
+	Field    JobCustomField // As it was before the change
+	OldValue string
+	NewValue string
+
+	NewInternalPermission    CustomFieldPermission
+	NewNonInternalPermission CustomFieldPermission
+}
+
+// What updateJobCustomFields did, or would do on a dry run
+type CustomFieldChangeSet struct {
+	Created   []JobCustomField
+	Updated   []CustomFieldChange
+	Unchanged []JobCustomField
+	Pruned    []JobCustomField // Deleted or blanked, per PruneMode
+	PruneMode CustomFieldPruning
+}
+
+func (changeSet CustomFieldChangeSet) HasChanges() bool {
+	return len(changeSet.Created) > 0 || len(changeSet.Updated) > 0 || len(changeSet.Pruned) > 0
+}
+
+// Values are masked so secrets from the environment don't end up in logs
+func (changeSet CustomFieldChangeSet) Print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANGE\tFIELD\tOLD VALUE\tNEW VALUE\tPERMISSIONS (INTERNAL/EXTERNAL)")
+	for _, field := range changeSet.Created {
+		fmt.Fprintf(w, "created\t%s\t\t%s\t%s/%s\n", customFieldKey(field), maskSecrets(field.Value), field.InternalPermission, field.NonInternalPermission)
+	}
+	for _, change := range changeSet.Updated {
+		fmt.Fprintf(w, "updated\t%s\t%s\t%s\t%s/%s\n", customFieldKey(change.Field), maskSecrets(change.OldValue), maskSecrets(change.NewValue), change.NewInternalPermission, change.NewNonInternalPermission)
+	}
+	for _, field := range changeSet.Unchanged {
+		fmt.Fprintf(w, "unchanged\t%s\t%s\t%s\t%s/%s\n", customFieldKey(field), maskSecrets(field.Value), maskSecrets(field.Value), field.InternalPermission, field.NonInternalPermission)
+	}
+	for _, field := range changeSet.Pruned {
+		fmt.Fprintf(w, "%s\t%s\t%s\t\t%s/%s\n", changeSet.prunedAction(), customFieldKey(field), maskSecrets(field.Value), field.InternalPermission, field.NonInternalPermission)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "%d created, %d updated, %d unchanged", len(changeSet.Created), len(changeSet.Updated), len(changeSet.Unchanged))
+	if changeSet.PruneMode != "" {
+		fmt.Fprintf(out, ", %d %s", len(changeSet.Pruned), changeSet.prunedAction())
+	}
+	fmt.Fprintln(out)
+}
+
+func (changeSet CustomFieldChangeSet) prunedAction() string {
+	if changeSet.PruneMode == PruneBlank {
+		return "blanked"
+	}
+	return "deleted"
+}
+
+// Fields named in protected_custom_fields are never pruned. Permissions say
+// nothing about who owns a field, fields created with internal_permission Read
+// are still ours to prune.
+func isProtectedCustomField(customField JobCustomField, protected []string) bool {
+	return containsString(protected, customField.Name)
+}
+
+// Builds the base custom field for a configured field, without a value.
+// Permissions are only set if they're configured, so fields whose permissions
+// aren't configured keep the ones they have. New fields get Edit, see
+// withDefaultPermissions.
+func customFieldFromConfiguration(fieldConfig MoraviaJobCustomFieldConfiguration, defaults MoraviaCustomFieldDefaultsConfiguration, job Job) JobCustomField {
+	customField := JobCustomField{}
+	customField.Group = firstNonEmpty(fieldConfig.Group, defaults.Group)
+	customField.Name = fieldConfig.Name
+	customField.DefinitionKey = fieldConfig.Name
+	customField.InternalPermission = CustomFieldPermission(firstNonEmpty(string(fieldConfig.Internal_permission), string(defaults.Internal_permission)))
+	customField.NonInternalPermission = CustomFieldPermission(firstNonEmpty(string(fieldConfig.External_permission), string(defaults.External_permission)))
+	customField.DefinitionFormatter = fieldConfig.Type
+	customField.DefinitionAdditionalData = strings.Join(fieldConfig.Choices[:], ",")
+	customField.IsLanguageSpecific = fieldConfig.Is_language_specific
+	customField.HandoffId = job.Id
+	return customField
+}
+
+// Edit for permissions that aren't configured, for creating a field
+func withDefaultPermissions(customField JobCustomField) JobCustomField {
+	customField.InternalPermission = CustomFieldPermission(firstNonEmpty(string(customField.InternalPermission), string(Edit)))
+	customField.NonInternalPermission = CustomFieldPermission(firstNonEmpty(string(customField.NonInternalPermission), string(Edit)))
+	return customField
+}
+
+// A problem with one configured custom field. Key is where in the field it
+// is, like value or values_by_language.de-DE.
+type customFieldError struct {
+	Key string
+	err error
+}
+
+func (e customFieldError) Error() string {
+	return e.err.Error()
+}
+
+// Builds the custom fields for a job from its template configuration.
+// Fields with values_by_language produce one field per target language,
+// falling back to value for languages that aren't listed. Every field is
+// checked, the errors are a multiError of customFieldErrors.
+func jobCustomFieldsFromTemplate(template MoraviaJobTemplateConfiguration, job Job) (JobCustomFields, error) {
+	customFields := JobCustomFields{}
+
+	dates, err := dateExpressionContextFromTemplate(template, time.Now())
+	if err != nil {
+		return customFields, err
+	}
+
+	var errs multiError
+	fail := func(key string, err error) {
+		errs = append(errs, customFieldError{key, err})
+	}
+
+	defaults := template.Custom_field_defaults
+	if err := validateCustomFieldPermission("custom_field_defaults internal_permission", defaults.Internal_permission); err != nil {
+		fail("custom_field_defaults.internal_permission", err)
+	}
+	if err := validateCustomFieldPermission("custom_field_defaults external_permission", defaults.External_permission); err != nil {
+		fail("custom_field_defaults.external_permission", err)
+	}
+
+	for _, fieldConfig := range template.Custom_fields {
+		if err := validateCustomFieldPermission("custom field \""+fieldConfig.Name+"\" internal_permission", fieldConfig.Internal_permission); err != nil {
+			fail("internal_permission", err)
+		}
+		if err := validateCustomFieldPermission("custom field \""+fieldConfig.Name+"\" external_permission", fieldConfig.External_permission); err != nil {
+			fail("external_permission", err)
+		}
+
+		// Empty rather than nil when extends scoped every value away, the field's
+		// still per language
+		if fieldConfig.Values_by_language == nil {
+			if fieldConfig.Is_required && len(fieldConfig.Value) == 0 {
+				fail("value", fmt.Errorf("custom field \"%s\" is required but has no value", fieldConfig.Name))
+				continue
+			}
+
+			value, err := customFieldValue(fieldConfig, fieldConfig.Value, dates)
+			if err != nil {
+				fail("value", err)
+				continue
+			}
+
+			customField := customFieldFromConfiguration(fieldConfig, defaults, job)
+			customField.Value = value
+			customFields.Value = append(customFields.Value, customField)
+			continue
+		}
+
+		if !fieldConfig.Is_language_specific {
+			fail("values_by_language", fmt.Errorf("custom field \"%s\" has values_by_language but is not language specific", fieldConfig.Name))
+			continue
+		}
+
+		targetLanguages := make(map[string]bool)
+		for _, language := range template.Target_languages {
+			targetLanguages[language] = true
+		}
+		var languages []string
+		for language := range fieldConfig.Values_by_language {
+			languages = append(languages, language)
+		}
+		sort.Strings(languages)
+		for _, language := range languages {
+			if !targetLanguages[language] {
+				fail("values_by_language."+language, fmt.Errorf("custom field \"%s\" has a value for %s, which isn't a target language", fieldConfig.Name, language))
+			}
+		}
+
+		var missingLanguages []string
+		fallbackFailed := false
+		for _, language := range template.Target_languages {
+			value, ok := fieldConfig.Values_by_language[language]
+			if !ok {
+				value = fieldConfig.Value
+			}
+			if len(value) == 0 {
+				missingLanguages = append(missingLanguages, language)
+				continue
+			}
+
+			normalizedValue, err := customFieldValue(fieldConfig, value, dates)
+			if err != nil {
+				// value is reported once, whichever languages fall back to it
+				if ok {
+					fail("values_by_language."+language, fmt.Errorf("%s (%s)", err, language))
+				} else if !fallbackFailed {
+					fail("value", err)
+					fallbackFailed = true
+				}
+				continue
+			}
+
+			customField := customFieldFromConfiguration(fieldConfig, defaults, job)
+			customField.LanguageCode = language
+			customField.Value = normalizedValue
+			customFields.Value = append(customFields.Value, customField)
+		}
+		if fieldConfig.Is_required && len(missingLanguages) > 0 {
+			fail("values_by_language", fmt.Errorf("custom field \"%s\" is required but has no value for: %s", fieldConfig.Name, strings.Join(missingLanguages, ", ")))
+		}
+	}
+
+	if len(errs) > 0 {
+		return customFields, errs
+	}
+	return customFields, nil
+}
+
+// Validates configured values against the field type and returns them in the form the API expects
+func customFieldValue(fieldConfig MoraviaJobCustomFieldConfiguration, values []string, dates dateExpressionContext) (string, error) {
+	switch fieldConfig.Type {
+	case "", Text, TextArea:
+		return strings.Join(values[:], ","), nil
+	case ChoicesMultiple:
+		if len(fieldConfig.Choices) == 0 {
+			return "", fmt.Errorf("custom field \"%s\" is %s but has no choices", fieldConfig.Name, fieldConfig.Type)
+		}
+		for _, value := range values {
+			if !containsString(fieldConfig.Choices, value) {
+				return "", fmt.Errorf("custom field \"%s\" value \"%s\" is not one of its choices: %s", fieldConfig.Name, value, strings.Join(fieldConfig.Choices, ", "))
+			}
+		}
+		return strings.Join(values[:], ","), nil
+	case Number, DateTime, Checkbox, Choices:
+		// Single valued types
+	default:
+		return "", fmt.Errorf("custom field \"%s\" has unknown type \"%s\"", fieldConfig.Name, fieldConfig.Type)
+	}
+
+	if len(values) == 0 {
+		return "", nil
+	}
+	if len(values) > 1 {
+		return "", fmt.Errorf("custom field \"%s\" is %s and takes a single value, got %d", fieldConfig.Name, fieldConfig.Type, len(values))
+	}
+	value := strings.TrimSpace(values[0])
+
+	switch fieldConfig.Type {
+	case Number:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("custom field \"%s\" value \"%s\" is not a number", fieldConfig.Name, value)
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64), nil
+	case DateTime:
+		location := dates.Location
+		if location == nil {
+			location = time.Local
+		}
+		if t, ok := dates.parseDate(value, location); ok {
+			return t.Format(moraviaDateTimeOffsetFormat), nil
+		}
+		t, err := evaluateDateExpression(value, dates)
+		if err != nil {
+			return "", fmt.Errorf("custom field \"%s\" value \"%s\" is not a date or date expression: %s", fieldConfig.Name, value, err)
+		}
+		return t.Format(moraviaDateTimeOffsetFormat), nil
+	case Checkbox:
+		switch strings.ToLower(value) {
+		case "true", "yes", "on", "1":
+			return "true", nil
+		case "false", "no", "off", "0":
+			return "false", nil
+		}
+		return "", fmt.Errorf("custom field \"%s\" value \"%s\" is not true or false", fieldConfig.Name, value)
+	default: // Choices
+		if len(fieldConfig.Choices) == 0 {
+			return "", fmt.Errorf("custom field \"%s\" is %s but has no choices", fieldConfig.Name, fieldConfig.Type)
+		}
+		if !containsString(fieldConfig.Choices, value) {
+			return "", fmt.Errorf("custom field \"%s\" value \"%s\" is not one of its choices: %s", fieldConfig.Name, value, strings.Join(fieldConfig.Choices, ", "))
+		}
+		return value, nil
+	}
+}
+
+func validateCustomFieldPermission(description string, permission CustomFieldPermission) error {
+	switch permission {
+	case "", None, Read, Edit:
+		return nil
+	}
+	return fmt.Errorf("%s \"%s\" must be one of %s, %s or %s", description, permission, None, Read, Edit)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Identifies a custom field on a job. Language specific fields exist once per language.
+func customFieldKey(customField JobCustomField) string {
+	if customField.LanguageCode == "" {
+		return customField.Name
+	}
+	return customField.Name + " (" + customField.LanguageCode + ")"
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What DateTime expressions are evaluated against. Expressions look like
+//
+//	+5 business days
+//	next friday 17:00 Europe/Prague
+//	release_date - 3d
+//
+// i.e. an optional base (now, today, tomorrow, next <weekday>, a named date or
+// an absolute date), any number of signed offsets, an optional time of day and
+// an optional IANA timezone.
+type dateExpressionContext struct {
+	Now      time.Time
+	Location *time.Location
+	Dates    map[string]string // Named dates, e.g. release_date: 2019-11-20
+	Holidays map[string]bool   // Skipped by business day offsets, keyed by 2006-01-02
+}
+
+var dateExpressionTimeOfDay = regexp.MustCompile(`^(\d{1,2}):(\d{2})$`)
+var dateExpressionOffset = regexp.MustCompile(`^(\d+)([a-z]*)$`)
+
+func dateExpressionContextFromTemplate(template MoraviaJobTemplateConfiguration, now time.Time) (dateExpressionContext, error) {
+	context := dateExpressionContext{}
+	context.Now = now
+	context.Location = time.Local
+	context.Dates = template.Dates
+
+	if template.Timezone != "" {
+		location, err := time.LoadLocation(template.Timezone)
+		if err != nil {
+			return context, fmt.Errorf("timezone \"%s\": %s", template.Timezone, err)
+		}
+		context.Location = location
+	}
+
+	if template.Holiday_calendar != "" {
+		holidays, err := readHolidayCalendar(template.Holiday_calendar)
+		if err != nil {
+			return context, err
+		}
+		context.Holidays = holidays
+	}
+
+	return context, nil
+}
+
+// Holiday calendars have one 2006-01-02 date per line. Anything after the
+// date is a description, and lines starting with # are comments.
+func readHolidayCalendar(filepath string) (map[string]bool, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	holidays := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		date := strings.Fields(line)[0]
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return nil, fmt.Errorf("%s:%d: \"%s\" is not a 2006-01-02 date", filepath, lineNumber, date)
+		}
+		holidays[date] = true
+	}
+	return holidays, scanner.Err()
+}
+
+func (context dateExpressionContext) parseDate(value string, location *time.Location) (time.Time, bool) {
+	for _, format := range customFieldDateTimeFormats {
+		if t, err := time.ParseInLocation(format, value, location); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (context dateExpressionContext) isBusinessDay(t time.Time) bool {
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false
+	}
+	return !context.Holidays[t.Format("2006-01-02")]
+}
+
+func (context dateExpressionContext) addBusinessDays(t time.Time, days int) time.Time {
+	step := 1
+	if days < 0 {
+		step = -1
+		days = -days
+	}
+	for days > 0 {
+		t = t.AddDate(0, 0, step)
+		if context.isBusinessDay(t) {
+			days--
+		}
+	}
+	return t
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func evaluateDateExpression(expression string, context dateExpressionContext) (time.Time, error) {
+	// Tokens keep their case for parseDate, ISO dates have a T and Z.
+	// Keywords, units and weekdays are matched lowercased.
+	var tokens []string
+	for _, token := range strings.Fields(expression) {
+		// Split signs off offsets like +5d, but not dates like 2019-11-20
+		if len(token) > 1 && (token[0] == '+' || token[0] == '-') {
+			tokens = append(tokens, token[:1], token[1:])
+		} else {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		return time.Time{}, fmt.Errorf("empty date expression")
+	}
+
+	location := context.Location
+	if location == nil {
+		location = time.Local
+	}
+	last := strings.Fields(expression)
+	if zone := last[len(last)-1]; strings.Contains(zone, "/") || zone == "UTC" {
+		loaded, err := time.LoadLocation(zone)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown timezone \"%s\"", zone)
+		}
+		location = loaded
+		tokens = tokens[:len(tokens)-1]
+	}
+
+	hour, minute := -1, -1
+	if len(tokens) > 0 {
+		if match := dateExpressionTimeOfDay.FindStringSubmatch(tokens[len(tokens)-1]); match != nil {
+			hour, _ = strconv.Atoi(match[1])
+			minute, _ = strconv.Atoi(match[2])
+			if hour > 23 || minute > 59 {
+				return time.Time{}, fmt.Errorf("\"%s\" is not a time of day", tokens[len(tokens)-1])
+			}
+			tokens = tokens[:len(tokens)-1]
+		}
+	}
+
+	now := context.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	now = now.In(location).Truncate(time.Second)
+
+	// Base
+	result := now
+	if len(tokens) > 0 && tokens[0] != "+" && tokens[0] != "-" {
+		base := tokens[0]
+		tokens = tokens[1:]
+		switch strings.ToLower(base) {
+		case "now":
+		case "today":
+			result = startOfDay(now)
+		case "tomorrow":
+			result = startOfDay(now).AddDate(0, 0, 1)
+		case "next":
+			if len(tokens) == 0 {
+				return time.Time{}, fmt.Errorf("\"next\" needs a weekday")
+			}
+			weekday, ok := parseWeekday(strings.ToLower(tokens[0]))
+			if !ok {
+				return time.Time{}, fmt.Errorf("\"%s\" is not a weekday", tokens[0])
+			}
+			tokens = tokens[1:]
+			days := (int(weekday) - int(now.Weekday()) + 7) % 7
+			if days == 0 {
+				days = 7
+			}
+			result = startOfDay(now).AddDate(0, 0, days)
+		default:
+			named, isNamed := context.Dates[base]
+			if !isNamed {
+				// Names are matched case-insensitively
+				for name, value := range context.Dates {
+					if strings.EqualFold(name, base) {
+						named, isNamed = value, true
+					}
+				}
+			}
+			value := base
+			if isNamed {
+				value = named
+			}
+			date, ok := context.parseDate(value, location)
+			if !ok {
+				if isNamed {
+					return time.Time{}, fmt.Errorf("date \"%s\" is \"%s\", which is not a date", base, named)
+				}
+				return time.Time{}, fmt.Errorf("\"%s\" is not a date or a named date", base)
+			}
+			result = date
+		}
+	}
+
+	// Offsets
+	for len(tokens) > 0 {
+		sign := 1
+		switch tokens[0] {
+		case "+":
+		case "-":
+			sign = -1
+		default:
+			return time.Time{}, fmt.Errorf("expected + or - before \"%s\"", tokens[0])
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return time.Time{}, fmt.Errorf("missing offset after sign")
+		}
+
+		match := dateExpressionOffset.FindStringSubmatch(strings.ToLower(tokens[0]))
+		if match == nil {
+			return time.Time{}, fmt.Errorf("\"%s\" is not an offset like 3d or 5 business days", tokens[0])
+		}
+		tokens = tokens[1:]
+		amount, _ := strconv.Atoi(match[1])
+		amount *= sign
+
+		unit := match[2]
+		if unit == "" {
+			if len(tokens) == 0 {
+				return time.Time{}, fmt.Errorf("missing unit after %s", match[1])
+			}
+			unit = strings.ToLower(tokens[0])
+			tokens = tokens[1:]
+		}
+		if (unit == "business" || unit == "working") && len(tokens) > 0 && strings.HasPrefix(strings.ToLower(tokens[0]), "day") {
+			unit = "bd"
+			tokens = tokens[1:]
+		}
+
+		switch unit {
+		case "m", "min", "mins", "minute", "minutes":
+			result = result.Add(time.Duration(amount) * time.Minute)
+		case "h", "hour", "hours":
+			result = result.Add(time.Duration(amount) * time.Hour)
+		case "d", "day", "days":
+			result = result.AddDate(0, 0, amount)
+		case "w", "week", "weeks":
+			result = result.AddDate(0, 0, 7*amount)
+		case "bd", "businessday", "businessdays":
+			result = context.addBusinessDays(result, amount)
+		default:
+			return time.Time{}, fmt.Errorf("unknown unit \"%s\"", unit)
+		}
+	}
+
+	if hour >= 0 {
+		result = time.Date(result.Year(), result.Month(), result.Day(), hour, minute, 0, 0, location)
+	}
+	return result, nil
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		if s == name || s == name[:3] {
+			return day, true
+		}
+	}
+	return time.Sunday, false
+}
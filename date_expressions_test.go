@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateDateExpression(t *testing.T) {
+	prague, err := time.LoadLocation("Europe/Prague")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A Thursday
+	now := time.Date(2026, 10, 15, 10, 30, 0, 0, prague)
+
+	tests := []struct {
+		name       string
+		expression string
+		now        time.Time
+		holidays   []string
+		expected   string // RFC 3339
+		err        string
+	}{
+		{name: "now", expression: "now", expected: "2026-10-15T10:30:00+02:00"},
+		{name: "today at a time", expression: "today 17:00", expected: "2026-10-15T17:00:00+02:00"},
+		{name: "keywords in any case", expression: "Tomorrow + 2 Days", expected: "2026-10-18T00:00:00+02:00"},
+		{name: "next weekday", expression: "next fri", expected: "2026-10-16T00:00:00+02:00"},
+		{name: "next weekday is never today", expression: "next thursday", expected: "2026-10-22T00:00:00+02:00"},
+		{name: "named date", expression: "release_date - 3d", expected: "2026-11-17T00:00:00+01:00"},
+		{name: "named dates in any case", expression: "Release_Date + 1w", expected: "2026-11-27T00:00:00+01:00"},
+		{name: "ISO date-time", expression: "2026-11-20T08:00:00Z + 1d", expected: "2026-11-21T08:00:00Z"},
+		{name: "hours and minutes", expression: "now +2h -15m", expected: "2026-10-15T12:15:00+02:00"},
+
+		// Business days skip weekends and holidays
+		{name: "business days over a weekend", expression: "+5 business days", expected: "2026-10-22T10:30:00+02:00"},
+		{name: "business days over a holiday", expression: "+5 business days", holidays: []string{"2026-10-19"}, expected: "2026-10-23T10:30:00+02:00"},
+		{name: "business days over a holiday on a weekend", expression: "+2bd", holidays: []string{"2026-10-17"}, expected: "2026-10-19T10:30:00+02:00"},
+		{name: "working days", expression: "+1 working day", now: time.Date(2026, 10, 16, 9, 0, 0, 0, prague), expected: "2026-10-19T09:00:00+02:00"},
+		{name: "business days back over a weekend", expression: "-1bd", now: time.Date(2026, 10, 19, 9, 0, 0, 0, prague), expected: "2026-10-16T09:00:00+02:00"},
+		{name: "business days from a weekend", expression: "+1 business day", now: time.Date(2026, 10, 17, 9, 0, 0, 0, prague), expected: "2026-10-19T09:00:00+02:00"},
+		{name: "business days back over holidays", expression: "release_date -2bd", holidays: []string{"2026-11-19", "2026-11-18"}, expected: "2026-11-16T00:00:00+01:00"},
+
+		// Days keep the time of day across a DST change, hours don't
+		{name: "days across the end of DST", expression: "now + 10d", expected: "2026-10-25T10:30:00+01:00"},
+		{name: "hours across the end of DST", expression: "2026-10-24T12:00:00+02:00 + 24h", expected: "2026-10-25T11:00:00+01:00"},
+		{name: "days across the start of DST", expression: "+1d", now: time.Date(2026, 3, 28, 12, 0, 0, 0, prague), expected: "2026-03-29T12:00:00+02:00"},
+		{name: "a time in the DST gap", expression: "tomorrow 02:30", now: time.Date(2026, 3, 28, 12, 0, 0, 0, prague), expected: "2026-03-29T03:30:00+02:00"},
+
+		// A trailing timezone overrides the template's
+		{name: "timezone", expression: "tomorrow 09:00 America/New_York", expected: "2026-10-16T09:00:00-04:00"},
+		{name: "UTC", expression: "today 23:00 UTC", expected: "2026-10-15T23:00:00Z"},
+		{name: "timezone changes the day", expression: "today UTC", now: time.Date(2026, 10, 16, 1, 0, 0, 0, prague), expected: "2026-10-15T00:00:00Z"},
+
+		{name: "empty", expression: " ", err: "empty date expression"},
+		{name: "next without a weekday", expression: "next", err: "needs a weekday"},
+		{name: "unknown weekday", expression: "next someday", err: "\"someday\" is not a weekday"},
+		{name: "unknown base", expression: "soon + 1d", err: "\"soon\" is not a date or a named date"},
+		{name: "unknown unit", expression: "+5 fortnights", err: "unknown unit \"fortnights\""},
+		{name: "missing unit", expression: "+5", err: "missing unit after 5"},
+		{name: "missing sign", expression: "today 5d", err: "expected + or - before \"5d\""},
+		{name: "bad time of day", expression: "today 25:00", err: "\"25:00\" is not a time of day"},
+		{name: "unknown timezone", expression: "today Mars/Olympus_Mons", err: "unknown timezone"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			context := dateExpressionContext{Now: now, Location: prague, Dates: map[string]string{"release_date": "2026-11-20"}}
+			if !test.now.IsZero() {
+				context.Now = test.now
+			}
+			context.Holidays = make(map[string]bool)
+			for _, holiday := range test.holidays {
+				context.Holidays[holiday] = true
+			}
+
+			result, err := evaluateDateExpression(test.expression, context)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error with %q, got %v (%v)", test.err, err, result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if formatted := result.Format(time.RFC3339); formatted != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, formatted)
+			}
+		})
+	}
+}
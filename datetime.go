@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"time"
+)
+
+// Moravia DateTimeOffset format, e.g. 2019-08-08T17:00:00.0000000+02:00
+const moraviaDateTimeOffsetFormat = "2006-01-02T15:04:05.0000000Z07:00"
+
+// Formats the API returns DateTimeOffset values in. The fraction is up to seven
+// digits and may be missing, as may the offset on older entities (those are UTC).
+var moraviaDateTimeOffsetParseFormats = []string{
+	"2006-01-02T15:04:05.9999999Z07:00",
+	"2006-01-02T15:04:05.9999999",
+}
+
+type MoraviaDateTimeOffset time.Time
+
+func parseMoraviaDateTimeOffset(s string) (MoraviaDateTimeOffset, error) {
+	var err error
+	for _, format := range moraviaDateTimeOffsetParseFormats {
+		var t time.Time
+		t, err = time.Parse(format, s)
+		if err == nil {
+			return MoraviaDateTimeOffset(t), nil
+		}
+	}
+	return MoraviaDateTimeOffset{}, err
+}
+
+func (j *MoraviaDateTimeOffset) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		*j = MoraviaDateTimeOffset{}
+		return nil
+	}
+	t, err := parseMoraviaDateTimeOffset(strings.Trim(string(b), "\""))
+	if err != nil {
+		return err
+	}
+	*j = t
+	return nil
+}
+
+func (j MoraviaDateTimeOffset) MarshalJSON() ([]byte, error) {
+	if j.IsZero() {
+		return []byte("null"), nil
+	}
+	return []byte("\"" + j.Format(moraviaDateTimeOffsetFormat) + "\""), nil
+}
+
+func (j MoraviaDateTimeOffset) Time() time.Time {
+	return time.Time(j)
+}
+
+func (j MoraviaDateTimeOffset) IsZero() bool {
+	return time.Time(j).IsZero()
+}
+
+func (j MoraviaDateTimeOffset) Format(s string) string {
+	return time.Time(j).Format(s)
+}
+
+func (j MoraviaDateTimeOffset) String() string {
+	return j.Format(moraviaDateTimeOffsetFormat)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMoraviaDateTimeOffsetJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		expected string // RFC 3339 with nanoseconds, "" for zero
+		err      bool
+	}{
+		{name: "seven digit fraction", json: `"2019-08-08T17:00:00.1234567+02:00"`, expected: "2019-08-08T17:00:00.1234567+02:00"},
+		{name: "shorter fraction", json: `"2019-08-08T17:00:00.5Z"`, expected: "2019-08-08T17:00:00.5Z"},
+		{name: "no fraction", json: `"2019-08-08T17:00:00-07:00"`, expected: "2019-08-08T17:00:00-07:00"},
+		{name: "no offset is UTC", json: `"2019-08-08T17:00:00.1234567"`, expected: "2019-08-08T17:00:00.1234567Z"},
+		{name: "null", json: `null`, expected: ""},
+		{name: "not a date", json: `"yesterday"`, err: true},
+		{name: "date only", json: `"2019-08-08"`, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var decoded MoraviaDateTimeOffset
+			err := json.Unmarshal([]byte(test.json), &decoded)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", decoded)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			formatted := ""
+			if !decoded.IsZero() {
+				formatted = decoded.Time().Format(time.RFC3339Nano)
+			}
+			if formatted != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, formatted)
+			}
+
+			// And back, in the format Moravia sends
+			encoded, err := json.Marshal(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var again MoraviaDateTimeOffset
+			if err := json.Unmarshal(encoded, &again); err != nil {
+				t.Fatalf("%s doesn't decode: %s", encoded, err)
+			}
+			if !again.Time().Equal(decoded.Time()) {
+				t.Errorf("expected %s to round trip, got %s", decoded, again)
+			}
+		})
+	}
+}
+
+func TestMoraviaDateTimeOffsetFormat(t *testing.T) {
+	prague, err := time.LoadLocation("Europe/Prague")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		time     time.Time
+		expected string
+	}{
+		{time.Date(2019, 8, 8, 17, 0, 0, 0, prague), `"2019-08-08T17:00:00.0000000+02:00"`},
+		{time.Date(2019, 12, 8, 17, 0, 0, 0, prague), `"2019-12-08T17:00:00.0000000+01:00"`},
+		{time.Date(2019, 8, 8, 17, 0, 0, 123456700, time.UTC), `"2019-08-08T17:00:00.1234567Z"`},
+		{time.Time{}, `null`},
+	}
+	for _, test := range tests {
+		encoded, err := json.Marshal(MoraviaDateTimeOffset(test.time))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, encoded)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Environments a configuration can have overlays for. moravia_production picks one.
+var moraviaEnvironments = []string{"test", "production"}
+
+func moraviaEnvironment() string {
+	if getenv("moravia_production", "false") == "true" {
+		return "production"
+	}
+	return "test"
+}
+
+// moravia.yml -> moravia.production.yml
+func environmentOverlayFile(file string, environment string) string {
+	extension := filepath.Ext(file)
+	return strings.TrimSuffix(file, extension) + "." + environment + extension
+}
+
+// Takes the environments section out of the base tree and merges the overlay
+// for environment over it, then moravia.<environment>.yml next to the base if
+// it exists. Positions of overlay values are moved to where they end up, so
+// errors point at the overlay.
+//
+// Mappings are merged key by key. Lists of mappings with an id or name, like
+// job_templates and custom_fields, are merged item by item. Other lists and
+// values are replaced.
+func applyEnvironmentOverlays(tree interface{}, file string, environment string, positions yamlPositions) (interface{}, configErrors) {
+	root, ok := tree.(map[interface{}]interface{})
+	if !ok {
+		return tree, nil
+	}
+
+	var errs configErrors
+	if section, exists := root["environments"]; exists {
+		delete(root, "environments")
+
+		overlays, ok := section.(map[interface{}]interface{})
+		if !ok && section != nil {
+			return tree, configErrors{{Path: "environments", Message: "expected a mapping"}}
+		}
+		for name := range overlays {
+			if !containsString(moraviaEnvironments, fmt.Sprint(name)) {
+				errs = append(errs, configError{Path: joinConfigPath("environments", fmt.Sprint(name)), Message: "unknown environment, expected one of: " + strings.Join(moraviaEnvironments, ", ")})
+			}
+		}
+		if overlay, exists := overlays[environment]; exists {
+			errs = append(errs, checkOverlay(overlay, "environments."+environment)...)
+			tree = mergeYAMLTrees(tree, overlay, "", "environments."+environment, positions, positions)
+		}
+	}
+
+	overlayFile := environmentOverlayFile(file, environment)
+	contents, err := ioutil.ReadFile(overlayFile)
+	if os.IsNotExist(err) {
+		return tree, errs
+	}
+	if err != nil {
+		return tree, append(errs, configError{File: overlayFile, Message: err.Error()})
+	}
+
+	var overlay interface{}
+	if err := yaml.Unmarshal(contents, &overlay); err != nil {
+		return tree, append(errs, configError{File: overlayFile, Message: err.Error()})
+	}
+	overlayPositions := locateYAMLPaths(string(contents))
+	for path, position := range overlayPositions {
+		position.File = overlayFile
+		overlayPositions[path] = position
+	}
+	for _, overlayErr := range checkOverlay(overlay, "") {
+		if position, ok := overlayPositions.find(overlayErr.Path); ok {
+			overlayErr.File = position.File
+			overlayErr.Line = position.Line
+			overlayErr.Column = position.Column
+		}
+		errs = append(errs, overlayErr)
+	}
+	tree = mergeYAMLTrees(tree, overlay, "", "", positions, overlayPositions)
+
+	return tree, errs
+}
+
+// Overlays are partial configurations, but can't have overlays of their own
+func checkOverlay(overlay interface{}, path string) configErrors {
+	if overlay == nil {
+		return nil
+	}
+	mapping, ok := overlay.(map[interface{}]interface{})
+	if !ok {
+		return configErrors{{Path: path, Message: "expected a mapping"}}
+	}
+	if _, nested := mapping["environments"]; nested {
+		return configErrors{{Path: joinConfigPath(path, "environments"), Message: "environments can't be nested"}}
+	}
+	return nil
+}
+
+func mergeYAMLTrees(base interface{}, overlay interface{}, path string, overlayPath string, positions yamlPositions, overlayPositions yamlPositions) interface{} {
+	if overlay == nil {
+		return base
+	}
+
+	switch overlayValue := overlay.(type) {
+	case map[interface{}]interface{}:
+		baseValue, ok := base.(map[interface{}]interface{})
+		if !ok {
+			break
+		}
+		for key, value := range overlayValue {
+			keyPath := joinConfigPath(path, fmt.Sprint(key))
+			keyOverlayPath := joinConfigPath(overlayPath, fmt.Sprint(key))
+			if _, exists := baseValue[key]; !exists {
+				positions.move(keyPath, keyOverlayPath, overlayPositions)
+				baseValue[key] = value
+				continue
+			}
+			baseValue[key] = mergeYAMLTrees(baseValue[key], value, keyPath, keyOverlayPath, positions, overlayPositions)
+		}
+		return baseValue
+	case []interface{}:
+		baseValue, ok := base.([]interface{})
+		if !ok || !hasItemKeys(baseValue) || !hasItemKeys(overlayValue) {
+			break
+		}
+		for i, item := range overlayValue {
+			itemOverlayPath := fmt.Sprintf("%s[%d]", overlayPath, i)
+			merged := false
+			for j, existing := range baseValue {
+				if itemKey(existing) == itemKey(item) {
+					baseValue[j] = mergeYAMLTrees(existing, item, fmt.Sprintf("%s[%d]", path, j), itemOverlayPath, positions, overlayPositions)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				positions.move(fmt.Sprintf("%s[%d]", path, len(baseValue)), itemOverlayPath, overlayPositions)
+				baseValue = append(baseValue, item)
+			}
+		}
+		return baseValue
+	}
+
+	positions.move(path, overlayPath, overlayPositions)
+	return overlay
+}
+
+// The id, or else the name, of a list item
+func itemKey(item interface{}) string {
+	mapping, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return ""
+	}
+	for _, key := range []string{"id", "name"} {
+		if value, exists := mapping[key]; exists && value != nil {
+			return key + "=" + fmt.Sprint(value)
+		}
+	}
+	return ""
+}
+
+func hasItemKeys(list []interface{}) bool {
+	for _, item := range list {
+		if itemKey(item) == "" {
+			return false
+		}
+	}
+	return len(list) > 0
+}
+
+// Replaces the positions at and under path with those at and under from in source
+func (positions yamlPositions) move(path string, from string, source yamlPositions) {
+	isUnder := func(candidate string, prefix string) (string, bool) {
+		if prefix == "" {
+			return candidate, true
+		}
+		if candidate == prefix {
+			return "", true
+		}
+		if strings.HasPrefix(candidate, prefix+".") || strings.HasPrefix(candidate, prefix+"[") {
+			return candidate[len(prefix):], true
+		}
+		return "", false
+	}
+
+	for candidate := range positions {
+		if _, under := isUnder(candidate, path); under && path != "" {
+			delete(positions, candidate)
+		}
+	}
+	for candidate, position := range source {
+		if rest, under := isUnder(candidate, from); under {
+			if path == "" {
+				rest = strings.TrimPrefix(rest, ".")
+			}
+			positions[path+rest] = position
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"gopkg.in/yaml.v2"
+	"reflect"
+	"testing"
+)
+
+func TestMergeYAMLTrees(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		overlay  string
+		expected string
+	}{
+		{
+			name:     "mappings key by key",
+			base:     "project: {id: 1}\njob_template: {source: en.xliff, source_language: en-US}",
+			overlay:  "project: {id: 2}\njob_template: {source_language: en-GB}",
+			expected: "project: {id: 2}\njob_template: {source: en.xliff, source_language: en-GB}",
+		},
+		{
+			name:     "custom fields by name",
+			base:     "custom_fields: [{name: Platform, choices: [iOS, Android], value: [iOS]}, {name: Reviewer, value: [Anna]}]",
+			overlay:  "custom_fields: [{name: Platform, value: [Android]}, {name: Deadline, value: [+5bd]}]",
+			expected: "custom_fields: [{name: Platform, choices: [iOS, Android], value: [Android]}, {name: Reviewer, value: [Anna]}, {name: Deadline, value: [+5bd]}]",
+		},
+		{
+			name:     "templates by id before name",
+			base:     "job_templates: [{id: app, name: App}, {id: web, name: Web}]",
+			overlay:  "job_templates: [{id: web, name: App}]",
+			expected: "job_templates: [{id: app, name: App}, {id: web, name: App}]",
+		},
+		{
+			name:     "nested lists by name",
+			base:     "job_templates: [{id: app, custom_fields: [{name: Platform, value: [iOS]}]}]",
+			overlay:  "job_templates: [{id: app, custom_fields: [{name: Platform, choices: [iOS]}]}]",
+			expected: "job_templates: [{id: app, custom_fields: [{name: Platform, value: [iOS], choices: [iOS]}]}]",
+		},
+		{
+			name:     "other lists are replaced",
+			base:     "target_languages: [de-DE, fr-FR]",
+			overlay:  "target_languages: [ja-JP]",
+			expected: "target_languages: [ja-JP]",
+		},
+		{
+			name:     "lists with an item without a name are replaced",
+			base:     "custom_fields: [{name: Platform}, {value: [x]}]",
+			overlay:  "custom_fields: [{name: Platform, value: [iOS]}]",
+			expected: "custom_fields: [{name: Platform, value: [iOS]}]",
+		},
+		{
+			name:     "values of another kind are replaced",
+			base:     "dates: {release_date: 2026-11-20}",
+			overlay:  "dates: tomorrow",
+			expected: "dates: tomorrow",
+		},
+		{
+			name:     "null keeps the base",
+			base:     "project: {id: 1}",
+			overlay:  "project: ~",
+			expected: "project: {id: 1}",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var base, overlay, expected interface{}
+			for _, document := range []struct {
+				text   string
+				target *interface{}
+			}{{test.base, &base}, {test.overlay, &overlay}, {test.expected, &expected}} {
+				if err := yaml.Unmarshal([]byte(document.text), document.target); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			merged := mergeYAMLTrees(base, overlay, "", "", make(yamlPositions), make(yamlPositions))
+			if !reflect.DeepEqual(merged, expected) {
+				got, _ := yaml.Marshal(merged)
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestMergeYAMLTreesMovesPositions(t *testing.T) {
+	base := "job_templates:\n  - id: app\n    target_languages: [de-DE]\n    source: en.xliff\n"
+	overlay := "job_templates:\n  - id: app\n    target_languages: [ja-JP, ko-KR]\n  - id: web\n"
+	var baseTree, overlayTree interface{}
+	if err := yaml.Unmarshal([]byte(base), &baseTree); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal([]byte(overlay), &overlayTree); err != nil {
+		t.Fatal(err)
+	}
+	positions := locateYAMLPaths(base)
+	overlayPositions := locateYAMLPaths(overlay)
+	for path, position := range overlayPositions {
+		position.File = "moravia.production.yml"
+		overlayPositions[path] = position
+	}
+	mergeYAMLTrees(baseTree, overlayTree, "", "", positions, overlayPositions)
+
+	tests := []struct {
+		path     string
+		expected yamlPosition
+	}{
+		{"job_templates[0].source", yamlPosition{Line: 4, Column: 5}},
+		{"job_templates[0].target_languages", yamlPosition{File: "moravia.production.yml", Line: 3, Column: 5}},
+		{"job_templates[0].target_languages[1]", yamlPosition{File: "moravia.production.yml", Line: 3, Column: 31}},
+		{"job_templates[1].id", yamlPosition{File: "moravia.production.yml", Line: 4, Column: 5}},
+	}
+	for _, test := range tests {
+		if position, _ := positions.find(test.path); position != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.path, test.expected, position)
+		}
+	}
+}
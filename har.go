@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP Archive 1.2, see http://www.softwareishard.com/blog/har-12-spec/
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+const harFileName = "moravia.har"
+
+// moravia_har_replay serves a recording instead of calling Moravia.
+// moravia_har_record writes every request and response to moravia.har in the
+// deploy directory. Recordings are redacted, so they can be attached to
+// support tickets.
+func newHARTransport(base http.RoundTripper) http.RoundTripper {
+	if path := getenv("moravia_har_replay", ""); path != "" {
+		replay, err := newHARReplayTransport(path)
+		if err != nil {
+			logs.Fatal("Failed to read HAR recording: " + err.Error())
+		}
+		return replay
+	}
+	if getenv("moravia_har_record", "false") == "true" {
+		return &harRecorder{base: base, path: filepath.Join(deployDir(), harFileName)}
+	}
+	return base
+}
+
+func isReplayingHAR() bool {
+	return getenv("moravia_har_replay", "") != ""
+}
+
+// Writes the whole file after every entry, so a run that exits part way
+// still leaves its requests behind
+type harRecorder struct {
+	base http.RoundTripper
+	path string
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+func (recorder *harRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := harEntry{}
+	entry.StartedDateTime = time.Now()
+	entry.Request = newHARRequest(req)
+
+	resp, err := recorder.base.RoundTrip(req)
+	elapsed := float64(time.Since(entry.StartedDateTime)) / float64(time.Millisecond)
+	entry.Time = elapsed
+	entry.Timings.Wait = elapsed
+	if err != nil {
+		// HAR has no field for transport errors, status 0 is what browsers record
+		entry.Response = harResponse{StatusText: err.Error(), Headers: []harNameValue{}, Cookies: []harNameValue{}}
+		recorder.record(entry)
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	entry.Response = newHARResponse(resp, body)
+	recorder.record(entry)
+
+	return resp, nil
+}
+
+func (recorder *harRecorder) record(entry harEntry) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	recorder.entries = append(recorder.entries, entry)
+	har := harFile{Log: harLog{Version: "1.2", Creator: harCreator{Name: "bitrise-step-moravia", Version: "1"}, Entries: recorder.entries}}
+	contents, err := json.MarshalIndent(har, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(recorder.path, contents, 0644)
+	}
+	if err != nil {
+		logs.Warn("Failed to write HAR recording: " + err.Error())
+	}
+}
+
+func newHARRequest(req *http.Request) harRequest {
+	request := harRequest{}
+	request.Method = req.Method
+	request.URL = req.URL.String()
+	request.HTTPVersion = req.Proto
+	request.Headers = harHeaders(req.Header)
+	request.QueryString = []harNameValue{}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			request.QueryString = append(request.QueryString, harNameValue{name, redact(value)})
+		}
+	}
+	request.Cookies = []harNameValue{}
+	request.HeadersSize = -1
+	request.BodySize = -1
+
+	if req.Body != nil && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			contents, _ := ioutil.ReadAll(body)
+			body.Close()
+			request.BodySize = len(contents)
+
+			mimeType := req.Header.Get("Content-Type")
+			text := string(contents)
+			if strings.HasPrefix(mimeType, "multipart/") {
+				// Uploaded files aren't kept, only their size
+				text = fmt.Sprintf("[%d bytes of multipart form data]", len(contents))
+			}
+			request.PostData = &harPostData{MimeType: mimeType, Text: redact(text)}
+		}
+	}
+	return request
+}
+
+func newHARResponse(resp *http.Response, body []byte) harResponse {
+	response := harResponse{}
+	response.Status = resp.StatusCode
+	response.StatusText = strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode)))
+	response.HTTPVersion = resp.Proto
+	response.Headers = harHeaders(resp.Header)
+	response.Cookies = []harNameValue{}
+	response.Content = harContent{Size: len(body), MimeType: resp.Header.Get("Content-Type"), Text: redact(string(body))}
+	response.HeadersSize = -1
+	response.BodySize = len(body)
+	return response
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			if strings.EqualFold(name, "Authorization") || strings.EqualFold(name, "Cookie") || strings.EqualFold(name, "Set-Cookie") {
+				value = maskedSecret
+			}
+			headers = append(headers, harNameValue{name, redact(value)})
+		}
+	}
+	return headers
+}
+
+// Answers requests with the recorded responses for the same method and URL, in
+// the order they were recorded. Once they run out the last one is repeated.
+type harReplayTransport struct {
+	mu        sync.Mutex
+	responses map[string][]harResponse
+}
+
+func newHARReplayTransport(path string) (*harReplayTransport, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har harFile
+	if err := json.Unmarshal(contents, &har); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	replay := &harReplayTransport{responses: make(map[string][]harResponse)}
+	for _, entry := range har.Log.Entries {
+		key := entry.Request.Method + " " + entry.Request.URL
+		replay.responses[key] = append(replay.responses[key], entry.Response)
+	}
+	logs.Info("Replaying HAR recording", "file", path, "entries", len(har.Log.Entries))
+	return replay, nil
+}
+
+func (replay *harReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	key := req.Method + " " + req.URL.String()
+	replay.mu.Lock()
+	responses := replay.responses[key]
+	if len(responses) == 0 {
+		replay.mu.Unlock()
+		return nil, fmt.Errorf("no recorded response for %s", key)
+	}
+	recorded := responses[0]
+	if len(responses) > 1 {
+		replay.responses[key] = responses[1:]
+	}
+	replay.mu.Unlock()
+
+	if recorded.Status == 0 {
+		return nil, fmt.Errorf("recorded failure: %s", recorded.StatusText)
+	}
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, recorded.StatusText),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(recorded.Content.Text)),
+		ContentLength: int64(len(recorded.Content.Text)),
+		Request:       req,
+	}
+	for _, header := range recorded.Headers {
+		resp.Header.Add(header.Name, header.Value)
+	}
+	// Redaction can change the body's length
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
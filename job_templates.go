@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Id of the template from the single job_template section
+const defaultJobTemplateId = "default"
+
+// The templates of a configuration with job_defaults and extends applied, in
+// file order. job_template, if present, comes first as "default".
+func resolveJobTemplates(configuration MoraviaConfiguration) ([]MoraviaJobTemplateConfiguration, error) {
+	var templates []MoraviaJobTemplateConfiguration
+	if !reflect.DeepEqual(configuration.Job_template, MoraviaJobTemplateConfiguration{}) {
+		template := configuration.Job_template
+		if template.Id == "" {
+			template.Id = defaultJobTemplateId
+		}
+		templates = append(templates, template)
+	}
+	templates = append(templates, configuration.Job_templates...)
+
+	byId := make(map[string]MoraviaJobTemplateConfiguration)
+	for i, template := range templates {
+		if template.Id == "" {
+			return nil, fmt.Errorf("job template %d needs an id", i+1)
+		}
+		if _, exists := byId[template.Id]; exists {
+			return nil, fmt.Errorf("job template id \"%s\" is used more than once", template.Id)
+		}
+		byId[template.Id] = template
+	}
+
+	var resolve func(id string, seen []string) (MoraviaJobTemplateConfiguration, error)
+	resolve = func(id string, seen []string) (MoraviaJobTemplateConfiguration, error) {
+		template := byId[id]
+		for _, seenId := range seen {
+			if seenId == id {
+				return template, fmt.Errorf("job template \"%s\" extends itself: %s", id, strings.Join(append(seen, id), " -> "))
+			}
+		}
+		if template.Extends == "" {
+			return mergeJobTemplates(configuration.Job_defaults, template), nil
+		}
+		if _, exists := byId[template.Extends]; !exists {
+			return template, fmt.Errorf("job template \"%s\" extends unknown template \"%s\"", id, template.Extends)
+		}
+		base, err := resolve(template.Extends, append(seen, id))
+		if err != nil {
+			return template, err
+		}
+		return mergeJobTemplates(base, template), nil
+	}
+
+	var resolved []MoraviaJobTemplateConfiguration
+	for _, template := range templates {
+		template, err := resolve(template.Id, nil)
+		if err != nil {
+			return nil, err
+		}
+		if template.Project == nil {
+			project := configuration.Project
+			template.Project = &project
+		}
+		resolved = append(resolved, template)
+	}
+	return resolved, nil
+}
+
+// Picks templates by the comma separated ids in selection. Empty or "all" selects every template.
+func selectJobTemplates(templates []MoraviaJobTemplateConfiguration, selection string) ([]MoraviaJobTemplateConfiguration, error) {
+	if selection == "" || selection == "all" {
+		return templates, nil
+	}
+
+	var selected []MoraviaJobTemplateConfiguration
+	for _, id := range strings.Split(selection, ",") {
+		id = strings.TrimSpace(id)
+		found := false
+		for _, template := range templates {
+			if template.Id == id {
+				selected = append(selected, template)
+				found = true
+				break
+			}
+		}
+		if !found {
+			var ids []string
+			for _, template := range templates {
+				ids = append(ids, template.Id)
+			}
+			return nil, fmt.Errorf("unknown job template \"%s\", the configuration has: %s", id, strings.Join(ids, ", "))
+		}
+	}
+	return selected, nil
+}
+
+// Fields set in override win. Maps and custom_field_defaults are merged key by
+// key, and custom fields are matched by name and merged the same way, like
+// environment overlays do, so a template can change just the value of one
+// inherited field. Id and extends aren't inherited. When override sets
+// target_languages, inherited values_by_language are scoped to them, so a
+// template can target fewer languages than the one it extends.
+func mergeJobTemplates(base MoraviaJobTemplateConfiguration, override MoraviaJobTemplateConfiguration) MoraviaJobTemplateConfiguration {
+	merged := base
+	mergeStructFields(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(override))
+
+	merged.Id = override.Id
+	merged.Extends = override.Extends
+
+	merged.Custom_fields = nil
+	for _, field := range base.Custom_fields {
+		if len(override.Target_languages) > 0 {
+			field = withValuesForLanguages(field, override.Target_languages)
+		}
+		merged.Custom_fields = append(merged.Custom_fields, field)
+	}
+	for _, field := range override.Custom_fields {
+		replaced := false
+		for i, existing := range merged.Custom_fields {
+			if existing.Name == field.Name {
+				mergeStructFields(reflect.ValueOf(&merged.Custom_fields[i]).Elem(), reflect.ValueOf(field))
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged.Custom_fields = append(merged.Custom_fields, field)
+		}
+	}
+
+	return merged
+}
+
+// Drops the values_by_language of languages that aren't in languages
+func withValuesForLanguages(field MoraviaJobCustomFieldConfiguration, languages []string) MoraviaJobCustomFieldConfiguration {
+	if len(field.Values_by_language) == 0 {
+		return field
+	}
+	values := make(map[string][]string)
+	for _, language := range languages {
+		if value, ok := field.Values_by_language[language]; ok {
+			values[language] = value
+		}
+	}
+	field.Values_by_language = values
+	return field
+}
+
+func mergeStructFields(merged reflect.Value, override reflect.Value) {
+	for i := 0; i < merged.NumField(); i++ {
+		field := merged.Field(i)
+		value := override.Field(i)
+
+		switch field.Kind() {
+		case reflect.Struct:
+			mergeStructFields(field, value)
+		case reflect.Map:
+			if value.Len() == 0 {
+				continue
+			}
+			combined := reflect.MakeMap(field.Type())
+			for _, key := range field.MapKeys() {
+				combined.SetMapIndex(key, field.MapIndex(key))
+			}
+			for _, key := range value.MapKeys() {
+				combined.SetMapIndex(key, value.MapIndex(key))
+			}
+			field.Set(combined)
+		default:
+			if !value.IsZero() {
+				field.Set(value)
+			}
+		}
+	}
+}
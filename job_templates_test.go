@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtendsMergesCustomFields(t *testing.T) {
+	field := MoraviaJobCustomFieldConfiguration{
+		Name:                 "Reviewer",
+		Is_language_specific: true,
+		Value:                []string{"Anyone"},
+		Values_by_language: map[string][]string{
+			"de-DE": {"Anna"},
+			"fr-FR": {"Bruno"},
+			"ja-JP": {"Chie"},
+		},
+	}
+	base := MoraviaJobTemplateConfiguration{
+		Id:               "base",
+		Target_languages: []string{"de-DE", "fr-FR", "ja-JP"},
+		Custom_fields:    []MoraviaJobCustomFieldConfiguration{field},
+	}
+
+	tests := []struct {
+		name   string
+		child  MoraviaJobTemplateConfiguration
+		values map[string]string // By language, "" for a field without one
+		err    string
+	}{
+		{
+			name:   "inherits every language",
+			child:  MoraviaJobTemplateConfiguration{Id: "child", Extends: "base"},
+			values: map[string]string{"de-DE": "Anna", "fr-FR": "Bruno", "ja-JP": "Chie"},
+		},
+		{
+			name:   "narrowed targets drop the other languages",
+			child:  MoraviaJobTemplateConfiguration{Id: "child", Extends: "base", Target_languages: []string{"de-DE"}},
+			values: map[string]string{"de-DE": "Anna"},
+		},
+		{
+			name:   "new targets fall back to value",
+			child:  MoraviaJobTemplateConfiguration{Id: "child", Extends: "base", Target_languages: []string{"es-ES"}},
+			values: map[string]string{"es-ES": "Anyone"},
+		},
+		{
+			name: "changing the value keeps the inherited values_by_language",
+			child: MoraviaJobTemplateConfiguration{
+				Id:               "child",
+				Extends:          "base",
+				Target_languages: []string{"de-DE", "es-ES"},
+				Custom_fields:    []MoraviaJobCustomFieldConfiguration{{Name: "Reviewer", Value: []string{"Web team"}}},
+			},
+			values: map[string]string{"de-DE": "Anna", "es-ES": "Web team"},
+		},
+		{
+			name: "the child's own values aren't scoped",
+			child: MoraviaJobTemplateConfiguration{
+				Id:               "child",
+				Extends:          "base",
+				Target_languages: []string{"de-DE"},
+				Custom_fields: []MoraviaJobCustomFieldConfiguration{{
+					Name:                 "Reviewer",
+					Is_language_specific: true,
+					Values_by_language:   map[string][]string{"fr-FR": {"Bruno"}},
+				}},
+			},
+			err: "has a value for fr-FR, which isn't a target language",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := MoraviaConfiguration{Job_templates: []MoraviaJobTemplateConfiguration{base, test.child}}
+			templates, err := resolveJobTemplates(configuration)
+			if err != nil {
+				t.Fatal(err)
+			}
+			customFields, err := jobCustomFieldsFromTemplate(templates[1], Job{})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error with %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			values := make(map[string]string)
+			for _, customField := range customFields.Value {
+				values[customField.LanguageCode] = customField.Value
+			}
+			if len(values) != len(test.values) {
+				t.Fatalf("expected %v, got %v", test.values, values)
+			}
+			for language, value := range test.values {
+				if values[language] != value {
+					t.Errorf("%s: expected %q, got %q", language, value, values[language])
+				}
+			}
+		})
+	}
+}
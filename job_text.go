@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Variables available to the name and description templates, e.g.
+//
+//	name: "{{.Date.Format \"2006-01-02\"}} {{.Branch}} ({{.ShortCommit}}) - iOS strings"
+//	description: "Build {{.BuildNumber}} of {{.AppVersion}}: {{.ChangedStrings}}"
+type jobTextData struct {
+	Template       MoraviaJobTemplateConfiguration
+	Date           time.Time // Submission time in the template timezone
+	Branch         string
+	Commit         string
+	ShortCommit    string
+	Tag            string
+	BuildNumber    string
+	AppVersion     string // From app_version_file, an Info.plist or build.gradle
+	ChangedStrings changedStringsSummary
+}
+
+type changedStringsSummary struct {
+	Added     int
+	Changed   int
+	Removed   int
+	Available bool // False if the source isn't in git or isn't a format we can read
+}
+
+func (summary changedStringsSummary) String() string {
+	if !summary.Available {
+		return "changed strings unknown"
+	}
+	return fmt.Sprintf("%d added, %d changed, %d removed", summary.Added, summary.Changed, summary.Removed)
+}
+
+// Renders the job name and description. Names without template actions keep
+// the original "20060102 - name" format.
+func renderJobText(jobTemplate MoraviaJobTemplateConfiguration, now time.Time) (string, string, error) {
+	location := time.Local
+	if jobTemplate.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(jobTemplate.Timezone)
+		if err != nil {
+			return "", "", fmt.Errorf("timezone \"%s\": %s", jobTemplate.Timezone, err)
+		}
+	}
+	now = now.In(location)
+
+	if !strings.Contains(jobTemplate.Name, "{{") && !strings.Contains(jobTemplate.Description, "{{") {
+		// Golang wat - https://gobyexample.com/time-formatting-parsing
+		return now.Format("20060102") + " - " + jobTemplate.Name, jobTemplate.Description, nil
+	}
+
+	data := jobTextDataFromEnvironment(jobTemplate, now)
+
+	name := now.Format("20060102") + " - " + jobTemplate.Name
+	if strings.Contains(jobTemplate.Name, "{{") {
+		var err error
+		name, err = executeJobTextTemplate("name", jobTemplate.Name, data)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	description, err := executeJobTextTemplate("description", jobTemplate.Description, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	return name, description, nil
+}
+
+func executeJobTextTemplate(name string, text string, data jobTextData) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("job %s template: %s", name, err)
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("job %s template: %s", name, err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+func jobTextDataFromEnvironment(jobTemplate MoraviaJobTemplateConfiguration, now time.Time) jobTextData {
+	data := jobTextData{}
+	data.Template = jobTemplate
+	data.Date = now
+
+	// Bitrise provides these, locally we ask git
+	data.Branch = getenv("BITRISE_GIT_BRANCH", gitOutput("rev-parse", "--abbrev-ref", "HEAD"))
+	data.Commit = getenv("BITRISE_GIT_COMMIT", getenv("GIT_CLONE_COMMIT_HASH", gitOutput("rev-parse", "HEAD")))
+	data.ShortCommit = data.Commit
+	if len(data.ShortCommit) > 7 {
+		data.ShortCommit = data.ShortCommit[:7]
+	}
+	data.Tag = getenv("BITRISE_GIT_TAG", gitOutput("describe", "--tags", "--exact-match"))
+	data.BuildNumber = getenv("BITRISE_BUILD_NUMBER", "")
+
+	if jobTemplate.App_version_file != "" {
+		version, err := readAppVersion(jobTemplate.App_version_file)
+		if err != nil {
+			warn("job template \"" + jobTemplate.Id + "\": failed to read app version: " + err.Error())
+		}
+		data.AppVersion = version
+	}
+
+	since := jobTemplate.Changed_strings_since
+	if since == "" {
+		since = "HEAD~1"
+	}
+	data.ChangedStrings = summarizeChangedStrings(jobTemplate.Source, since)
+
+	return data
+}
+
+func gitOutput(args ...string) string {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+var infoPlistVersion = regexp.MustCompile(`<key>CFBundleShortVersionString</key>\s*<string>([^<]*)</string>`)
+var gradleVersion = regexp.MustCompile(`versionName\s*=?\s*["']([^"']+)["']`)
+
+// Reads the marketing version from an Info.plist or the versionName from a build.gradle
+func readAppVersion(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	versionPattern := gradleVersion
+	if strings.HasSuffix(path, ".plist") {
+		versionPattern = infoPlistVersion
+	}
+	match := versionPattern.FindSubmatch(contents)
+	if match == nil {
+		return "", fmt.Errorf("no version found in %s", path)
+	}
+	return string(match[1]), nil
+}
+
+// Compares the strings in the source with the version at since
+func summarizeChangedStrings(source string, since string) changedStringsSummary {
+	summary := changedStringsSummary{}
+
+	current, err := ioutil.ReadFile(source)
+	if err != nil {
+		return summary
+	}
+	absolute, err := filepath.Abs(source)
+	if err != nil {
+		return summary
+	}
+	relative := gitOutput("-C", filepath.Dir(absolute), "ls-files", "--full-name", filepath.Base(absolute))
+	if relative == "" {
+		return summary
+	}
+	previous, err := exec.Command("git", "-C", filepath.Dir(absolute), "show", since+":"+relative).Output()
+	if err != nil {
+		// New in this revision, everything is added
+		previous = nil
+	}
+
+	currentStrings, ok := readLocalizableStrings(source, current)
+	if !ok {
+		return summary
+	}
+	previousStrings := map[string]string{}
+	if previous != nil {
+		previousStrings, ok = readLocalizableStrings(source, previous)
+		if !ok {
+			return summary
+		}
+	}
+
+	for id, text := range currentStrings {
+		previousText, existed := previousStrings[id]
+		if !existed {
+			summary.Added++
+		} else if previousText != text {
+			summary.Changed++
+		}
+	}
+	for id := range previousStrings {
+		if _, exists := currentStrings[id]; !exists {
+			summary.Removed++
+		}
+	}
+	summary.Available = true
+	return summary
+}
+
+var appleStringsEntry = regexp.MustCompile(`(?m)^\s*"((?:[^"\\]|\\.)*)"\s*=\s*"((?:[^"\\]|\\.)*)"\s*;`)
+
+// Reads id to source text from XLIFF or Apple .strings files
+func readLocalizableStrings(path string, contents []byte) (map[string]string, bool) {
+	localizableStrings := make(map[string]string)
+
+	switch filepath.Ext(path) {
+	case ".xliff", ".xlf":
+		var document struct {
+			Files []struct {
+				Original string `xml:"original,attr"`
+				Units    []struct {
+					Id     string `xml:"id,attr"`
+					Source string `xml:"source"`
+				} `xml:"body>trans-unit"`
+			} `xml:"file"`
+		}
+		if err := xml.Unmarshal(contents, &document); err != nil {
+			logs.Warn("Failed to read " + path + ": " + err.Error())
+			return nil, false
+		}
+		for _, file := range document.Files {
+			for _, unit := range file.Units {
+				localizableStrings[file.Original+"/"+unit.Id] = unit.Source
+			}
+		}
+	case ".strings":
+		for _, match := range appleStringsEntry.FindAllSubmatch(contents, -1) {
+			localizableStrings[string(match[1])] = string(match[2])
+		}
+	default:
+		return nil, false
+	}
+
+	return localizableStrings, true
+}
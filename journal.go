@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Records each step of a submission as it completes, so a run that's killed
+// part way can be finished with -resume instead of creating another job.
+// Methods are safe to call on a nil journal, which records nothing.
+type submissionJournal struct {
+	mu   sync.Mutex
+	path string
+
+	Environment string                   `json:"environment"`
+	StartedAt   time.Time                `json:"started_at"`
+	Templates   map[string]*journalEntry `json:"templates"`
+}
+
+// What has been done for one job template
+type journalEntry struct {
+	Job              Job                 `json:"job"`
+	CustomFieldsDone bool                `json:"custom_fields_done"`
+	CustomFields     []string            `json:"custom_fields,omitempty"` // Created or updated
+	Attachments      []journalAttachment `json:"attachments,omitempty"`
+	Completed        bool                `json:"completed"`
+}
+
+type journalAttachment struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// moravia_state_file, .moravia-state.json in the working directory by default
+func journalPath() string {
+	return getenv("moravia_state_file", ".moravia-state.json")
+}
+
+// With resume, picks up the journal left by the last run. Otherwise starts a new
+// one, warning if the last run didn't finish.
+func openJournal(path string, resume bool) (*submissionJournal, error) {
+	previous, err := readJournal(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if resume {
+		if previous == nil {
+			return nil, fmt.Errorf("nothing to resume, %s doesn't exist", path)
+		}
+		if previous.Environment != moraviaEnvironment() {
+			return nil, fmt.Errorf("%s is from the %s environment, not %s", path, previous.Environment, moraviaEnvironment())
+		}
+		logs.Info("Resuming submission", "file", path, "started", previous.StartedAt.Format(time.RFC3339))
+		return previous, nil
+	}
+
+	if previous != nil {
+		if incomplete := previous.incompleteTemplates(); len(incomplete) > 0 {
+			logs.Warn("The last submission didn't finish (" + strings.Join(incomplete, ", ") + "), starting a new one. Run with -resume to finish it instead.")
+		}
+	}
+	journal := &submissionJournal{path: path}
+	journal.Environment = moraviaEnvironment()
+	journal.StartedAt = time.Now()
+	journal.Templates = make(map[string]*journalEntry)
+	return journal, journal.write()
+}
+
+func readJournal(path string) (*submissionJournal, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	journal := &submissionJournal{path: path}
+	if err := json.Unmarshal(contents, journal); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if journal.Templates == nil {
+		journal.Templates = make(map[string]*journalEntry)
+	}
+	return journal, nil
+}
+
+func (journal *submissionJournal) incompleteTemplates() []string {
+	var ids []string
+	for id, entry := range journal.Templates {
+		if !entry.Completed && entry.Job.Id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// A copy of the template's entry, nil if nothing was recorded for it
+func (journal *submissionJournal) entry(templateId string) *journalEntry {
+	if journal == nil {
+		return nil
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	entry, ok := journal.Templates[templateId]
+	if !ok {
+		return nil
+	}
+	copied := *entry
+	return &copied
+}
+
+// Changes the template's entry and writes the journal
+func (journal *submissionJournal) update(templateId string, change func(entry *journalEntry)) {
+	if journal == nil {
+		return
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	entry, ok := journal.Templates[templateId]
+	if !ok {
+		entry = &journalEntry{}
+		journal.Templates[templateId] = entry
+	}
+	change(entry)
+	if err := journal.write(); err != nil {
+		logs.Warn("Failed to write " + journal.path + ": " + err.Error())
+	}
+}
+
+// Forgets a template whose job was rolled back, so resuming creates a new one
+func (journal *submissionJournal) remove(templateId string) {
+	if journal == nil {
+		return
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	delete(journal.Templates, templateId)
+	if err := journal.write(); err != nil {
+		logs.Warn("Failed to write " + journal.path + ": " + err.Error())
+	}
+}
+
+// Written to a temporary file and renamed, so a kill never leaves half a journal
+func (journal *submissionJournal) write() error {
+	contents, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(journal.path), ".moravia-state-")
+	if err != nil {
+		return err
+	}
+	_, err = temporary.Write(append(contents, '\n'))
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	return os.Rename(temporary.Name(), journal.path)
+}
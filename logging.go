@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{levelDebug: "debug", levelInfo: "info", levelWarn: "warn", levelError: "error"}
+
+// Leveled logger. Messages are plain text, or JSON lines with moravia_log_format
+// json. Everything logged goes through redact.
+//
+//	logs.Info("Created job", "id", job.Id)
+type logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  logLevel
+	asJSON bool
+}
+
+var logs = newLoggerFromEnvironment()
+
+// moravia_log_level is debug, info, warn or error. moravia_debug also logs
+// every request and response.
+func newLoggerFromEnvironment() *logger {
+	l := &logger{out: os.Stdout, level: levelInfo}
+	for level, name := range logLevelNames {
+		if getenv("moravia_log_level", "info") == name {
+			l.level = level
+		}
+	}
+	if isDebugLogging() {
+		l.level = levelDebug
+	}
+	l.asJSON = getenv("moravia_log_format", "text") == "json"
+	return l
+}
+
+func isDebugLogging() bool {
+	return getenv("moravia_debug", "false") == "true"
+}
+
+// Sends the standard library logger, used by log.Fatal, through logs
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
+
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logs.log(levelError, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+func (l *logger) Debug(message string, fields ...interface{}) { l.log(levelDebug, message, fields) }
+func (l *logger) Info(message string, fields ...interface{})  { l.log(levelInfo, message, fields) }
+func (l *logger) Warn(message string, fields ...interface{})  { l.log(levelWarn, message, fields) }
+func (l *logger) Error(message string, fields ...interface{}) { l.log(levelError, message, fields) }
+
+// Logs an error and exits
+func (l *logger) Fatal(message string, fields ...interface{}) {
+	l.log(levelError, message, fields)
+	os.Exit(1)
+}
+
+// fields are key, value pairs
+func (l *logger) log(level logLevel, message string, fields []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	keys := []string{}
+	values := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		keys = append(keys, key)
+		values[key] = redact(fmt.Sprint(fields[i+1]))
+	}
+	message = redact(message)
+
+	var line string
+	if l.asJSON {
+		entry := map[string]string{"time": time.Now().Format(time.RFC3339), "level": logLevelNames[level], "msg": message}
+		for key, value := range values {
+			if _, reserved := entry[key]; !reserved {
+				entry[key] = value
+			}
+		}
+		encoded, _ := json.Marshal(entry)
+		line = string(encoded)
+	} else {
+		switch level {
+		case levelDebug:
+			line = "Debug: "
+		case levelWarn:
+			line = "Warning: "
+		case levelError:
+			line = "Error: "
+		}
+		line += message
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := values[key]
+			if strings.ContainsAny(value, " \"\n") {
+				value = fmt.Sprintf("%q", value)
+			}
+			line += " " + key + "=" + value
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.out, line)
+}
+
+var redactionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(authorization:\s*)[^\r\n]+`),
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]+=*`),
+	regexp.MustCompile(`(?i)((?:client_secret|access_token|refresh_token|id_token|password)=)[^&\s"]+`),
+	regexp.MustCompile(`(?i)("(?:client_secret|access_token|refresh_token|id_token|password)"\s*:\s*")[^"]*`),
+}
+
+// Masks registered secrets, Authorization headers, bearer tokens, and secrets
+// in form and JSON bodies
+func redact(s string) string {
+	s = maskSecrets(s)
+	for _, pattern := range redactionPatterns {
+		s = pattern.ReplaceAllString(s, "${1}"+maskedSecret)
+	}
+	return s
+}
+
+// With moravia_debug, logs every request and response, redacted
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+func (transport debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isDebugLogging() {
+		return transport.base.RoundTrip(req)
+	}
+
+	// Multipart uploads are logged without their files
+	dumpBody := !strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/")
+	dump, err := httputil.DumpRequestOut(req, dumpBody)
+	if err == nil {
+		logs.Debug("Request\n" + strings.TrimSpace(string(dump)))
+	}
+
+	started := time.Now()
+	resp, err := transport.base.RoundTrip(req)
+	if err != nil {
+		logs.Debug("Request failed", "url", req.URL, "error", err)
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	dump, _ = httputil.DumpResponse(resp, false)
+	logs.Debug("Response\n"+strings.TrimSpace(string(dump))+"\n\n"+string(body), "duration", time.Since(started).Round(time.Millisecond))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return resp, nil
+}
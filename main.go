@@ -2,50 +2,29 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"gopkg.in/yaml.v2"
 	"io"
 	"io/ioutil"
-	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// type MoraviaDateTimeOffset time.Time
-//
-// func (j *MoraviaDateTimeOffset) UnmarshalJSON(b []byte) error {
-//     s := strings.Trim(string(b), "\"")
-//     t, err := time.Parse("2006-01-02T15:04:05.9999999Z", s)
-//     if err != nil {
-//         return err
-//     }
-//     *j = MoraviaDateTimeOffset(t)
-//     return nil
-// }
-//
-// func (j MoraviaDateTimeOffset) MarshalJSON() ([]byte, error) {
-//     s := j.Format("2006-01-02T15:04:05.9999999Z")
-//     return []byte(s), nil
-// }
-//
-// // Maybe a Format function for printing your date
-// func (j MoraviaDateTimeOffset) Format(s string) string {
-//     t := time.Time(j)
-//     return t.Format(s)
-// }
-
 var clientID string
 var clientSecret string
 var serviceAccount string
 
-var httpClient = &http.Client{Timeout: 200 * time.Second}
+var httpClient = &http.Client{Transport: newRateLimitTransport(debugTransport{newHARTransport(http.DefaultTransport)})}
 
 func getenv(key, fallback string) string {
 	value := os.Getenv(key)
@@ -89,77 +68,37 @@ func moraviaProjectsURL() string {
 	return moraviaBaseURL() + "/Projects"
 }
 
-type MoraviaProjectConfiguration struct {
-	Id int `yaml:"id"`
-}
-
-type MoraviaJobCustomFieldConfiguration struct {
-	Group                string          `yaml:"group"`
-	Name                 string          `yaml:"name"`
-	Type                 CustomFieldType `yaml:"type"`
-	Choices              []string        `yaml:"choices"`
-	Is_language_specific bool            `yaml:"is_language_specific"`
-	Value                []string        `yaml:"value"`
-}
-
-type MoraviaJobTemplateConfiguration struct {
-	Name             string                               `yaml:"name"`
-	Source           string                               `yaml:"source"`
-	Source_language  string                               `yaml:"source_language"`
-	Target_languages []string                             `yaml:"target_languages"`
-	Custom_fields    []MoraviaJobCustomFieldConfiguration `yaml:"custom_fields"`
-}
-
-type MoraviaConfiguration struct {
-	Project      MoraviaProjectConfiguration     `yaml:"project"`
-	Job_template MoraviaJobTemplateConfiguration `yaml:"job_template"`
-}
-
-func (config *MoraviaConfiguration) readFromFile(filepath string) *MoraviaConfiguration {
-	yamlFile, err := ioutil.ReadFile(filepath)
-	if err != nil {
-		log.Fatal(err)
-		return nil
-	}
-	err = yaml.Unmarshal(yamlFile, config)
-	if err != nil {
-		log.Fatal(err)
-		return nil
-	}
-
-	return config
-}
-
 type AuthenticateResponse struct {
 	Access_token string `json:"access_token"`
 	Expires_in   int    `json:"expires_in"`
 	Token_type   string `json:"token_type"`
 }
 
-func authenticate(clientID string, clientSecret string, serviceAccount string, target interface{}) error {
+func authenticate(ctx context.Context, clientID string, clientSecret string, serviceAccount string, target interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
 	var bodyString = "grant_type=service"
 	bodyString += "&client_id=" + clientID
 	bodyString += "&client_secret=" + clientSecret
 	bodyString += "&scope=symfonie2-api&service_account=" + serviceAccount
 
 	body := strings.NewReader(bodyString)
-	req, err := http.NewRequest("POST", moraviaLoginURL(), body)
+	req, err := http.NewRequestWithContext(ctx, "POST", moraviaLoginURL(), body)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	// responseData, sErr := ioutil.ReadAll(resp.Body)
-	// if sErr != nil {
-	//
-	// }
-	// fmt.Println(string(responseData))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to authenticate with Moravia: %s", resp.Status)
+	}
 
 	return json.NewDecoder(resp.Body).Decode(target)
 }
@@ -168,9 +107,11 @@ type Job struct {
 	Id                  int
 	Name                string `yaml:"name"`
 	ProjectId           int
-	Description         string   `yaml:"description"`
-	SourceLanguageCode  string   `yaml:"source_language"`
-	TargetLanguageCodes []string `yaml:"target_languages"`
+	Description         string                 `yaml:"description"`
+	SourceLanguageCode  string                 `yaml:"source_language"`
+	TargetLanguageCodes []string               `yaml:"target_languages"`
+	CreatedAt           *MoraviaDateTimeOffset `json:",omitempty"`
+	DueDate             *MoraviaDateTimeOffset `json:",omitempty"`
 }
 
 type Jobs struct {
@@ -186,74 +127,67 @@ func moraviaPortalJobDetailsURL(job Job) string {
 	}
 }
 
-func jobFromTemplate(filepath string, target interface{}) {
-	// TODO: Alex - fill in template
-}
-
-func findJob(name string, auth AuthenticateResponse, target interface{}) error {
-	var bodyString = ""
-
-	body := strings.NewReader(bodyString)
+// Jobs called name in the project, newest first
+func findJob(ctx context.Context, name string, projectId int, auth AuthenticateResponse, target interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
 
-	// https://projects.moravia.com/api/V3/Jobs?$filter=State eq Moravia.Symfonie.Data.JobState'Order'
-
-	projectSearchURL := moraviaJobsURL() + "?$filter=State eq " + "Moravia.Symfonie.Data.JobState'" + name + "'"
-	// projectSearchURL := moraviaProjectsURL + "?$filter=Id eq 111111"
-	fmt.Println(projectSearchURL)
-
-	req, err := http.NewRequest("GET", projectSearchURL, body)
+	filter := "Name eq " + odataString(name) + " and ProjectId eq " + strconv.Itoa(projectId)
+	searchURL := moraviaJobsURL() + "?$filter=" + odataQueryEscape(filter) + "&$orderby=Id%20desc"
+	req, err := http.NewRequestWithContext(ctx, "GET", searchURL, nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	// req.Header.Set("Content-Type", "application/json")
 	authorization_value := "Bearer " + auth.Access_token
 	req.Header.Set("Authorization", authorization_value)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	responseData, sErr := ioutil.ReadAll(resp.Body)
-	if sErr != nil {
-		log.Fatal(sErr)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to find job %q in project %d: %s", name, projectId, resp.Status)
 	}
-	fmt.Println(string(responseData))
-
-	return nil
 
-	// return json.NewDecoder(resp.Body).Decode(target)
+	return json.NewDecoder(resp.Body).Decode(target)
 }
 
-func listJobs(auth AuthenticateResponse, target interface{}) error {
-	var bodyString = ""
+func listJobs(ctx context.Context, auth AuthenticateResponse, target interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
 
-	body := strings.NewReader(bodyString)
-	req, err := http.NewRequest("GET", moraviaJobsURL(), body)
+	req, err := http.NewRequestWithContext(ctx, "GET", moraviaJobsURL(), nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	// req.Header.Set("Content-Type", "application/json")
 	authorization_value := "Bearer " + auth.Access_token
 	req.Header.Set("Authorization", authorization_value)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list jobs: %s", resp.Status)
+	}
+
 	return json.NewDecoder(resp.Body).Decode(target)
 }
 
-func createJob(job Job, auth AuthenticateResponse, target interface{}) error {
+func createJob(ctx context.Context, job Job, auth AuthenticateResponse, target interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
 	body := new(bytes.Buffer)
 	json.NewEncoder(body).Encode(job)
 
-	req, err := http.NewRequest("POST", moraviaJobsURL(), body)
+	req, err := http.NewRequestWithContext(ctx, "POST", moraviaJobsURL(), body)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	authorization_value := "Bearer " + auth.Access_token
@@ -261,25 +195,47 @@ func createJob(job Job, auth AuthenticateResponse, target interface{}) error {
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 201 {
-		fmt.Println("Created job " + job.Name)
-	} else {
-		fmt.Println("Failed to create job")
-		fmt.Println(resp)
+	if resp.StatusCode != 201 {
+		return fmt.Errorf("failed to create job: %s", resp.Status)
 	}
+	logs.Info("Created job", "name", job.Name)
 
-	// responseData, sErr := ioutil.ReadAll(resp.Body)
-	// if sErr != nil {
-	//     log.Fatal(sErr)
-	// }
-	// fmt.Println(string(responseData))
-	// return nil
+	if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return unreadableJobError{err}
+	}
+	return nil
+}
 
-	return json.NewDecoder(resp.Body).Decode(target)
+// Moravia created the job, but its response couldn't be read so its id isn't known
+type unreadableJobError struct {
+	err error
+}
+
+func (e unreadableJobError) Error() string {
+	return "created job, but couldn't read the response: " + e.err.Error()
+}
+
+// Looks up a job createJob couldn't read back, by its name and project. It's
+// a cleanup step, so like rolling back it works after the run is cancelled.
+func findCreatedJob(auth AuthenticateResponse, job Job) (Job, error) {
+	ctx, cancel := rollbackContext()
+	defer cancel()
+
+	jobs := Jobs{}
+	if err := findJob(ctx, job.Name, job.ProjectId, auth, &jobs); err != nil {
+		return job, err
+	}
+	if len(jobs.Value) == 0 {
+		return job, fmt.Errorf("there's no job called \"%s\" in project %d", job.Name, job.ProjectId)
+	}
+	if len(jobs.Value) > 1 {
+		logs.Warn("Several jobs have the created job's name, using the newest", "name", job.Name, "id", jobs.Value[0].Id)
+	}
+	return jobs.Value[0], nil
 }
 
 type CustomFieldType string
@@ -303,135 +259,314 @@ const (
 )
 
 type JobCustomField struct {
-	CustomFieldId            int                   `json:",omitempty"` // Identifier
-	DefinitionAdditionalData string                `json:",omitempty"` // Will be csl list of choices for choice/multi-choice
-	DefinitionFormatter      CustomFieldType       `json:",omitempty"` // What kind of field is this - Choices, Text, etc.
-	DefinitionKey            string                `json:",omitempty"` // Shadow copy of field name?
-	Group                    string                `json:",omitempty"` // User facing name of group this field is shown under
-	HandoffId                int                   `json:",omitempty"` // Job ID
-	InternalPermission       CustomFieldPermission `json:",omitempty"` // Read/Edit permission for internal users
-	IsLanguageSpecific       bool                  `json:",omitempty"` // True if this field is language-specific
-	Name                     string                `json:",omitempty"` // User facing name of field
-	NonInternalPermission    CustomFieldPermission `json:",omitempty"` // Read/Edit permission for externals
-	RequestorId              int                   `json:",omitempty"` // ID of the user who requested this field
-	// UpdatedAt                MoraviaDateTimeOffset
-	Value string `json:",omitempty"` // Value of this field
+	CustomFieldId            int                    `json:",omitempty"` // Identifier
+	DefinitionAdditionalData string                 `json:",omitempty"` // Will be csl list of choices for choice/multi-choice
+	DefinitionFormatter      CustomFieldType        `json:",omitempty"` // What kind of field is this - Choices, Text, etc.
+	DefinitionKey            string                 `json:",omitempty"` // Shadow copy of field name?
+	Group                    string                 `json:",omitempty"` // User facing name of group this field is shown under
+	HandoffId                int                    `json:",omitempty"` // Job ID
+	InternalPermission       CustomFieldPermission  `json:",omitempty"` // Read/Edit permission for internal users
+	IsLanguageSpecific       bool                   `json:",omitempty"` // True if this field is language-specific
+	LanguageCode             string                 `json:",omitempty"` // Target language of a language-specific field
+	Name                     string                 `json:",omitempty"` // User facing name of field
+	NonInternalPermission    CustomFieldPermission  `json:",omitempty"` // Read/Edit permission for externals
+	RequestorId              int                    `json:",omitempty"` // ID of the user who requested this field
+	UpdatedAt                *MoraviaDateTimeOffset `json:",omitempty"` // Last change to this field
+	Value                    string                 `json:",omitempty"` // Value of this field
+}
+
+// PATCH body for a custom field. Value is always sent, so a field can be blanked.
+type JobCustomFieldPatch struct {
+	InternalPermission    CustomFieldPermission `json:",omitempty"`
+	NonInternalPermission CustomFieldPermission `json:",omitempty"`
+	Value                 string
 }
 
 type JobCustomFields struct {
 	Value []JobCustomField `json:"value"`
 }
 
-func listJobCustomFieldsForJob(auth AuthenticateResponse, job Job, target interface{}) error {
+func listJobCustomFieldsForJob(ctx context.Context, auth AuthenticateResponse, job Job, target interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
 	var bodyString = ""
 
 	body := strings.NewReader(bodyString)
 	url := moraviaJobCustomFieldsURL() + "?$filter=HandoffId%20eq%20" + strconv.Itoa(job.Id)
-	req, err := http.NewRequest("GET", url, body)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, body)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	authorization_value := "Bearer " + auth.Access_token
 	req.Header.Set("Authorization", authorization_value)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	// If you want to print out the JSON response
-	// responseData, sErr := ioutil.ReadAll(resp.Body)
-	// if sErr != nil {
-	//     log.Fatal(sErr)
-	// }
-	// fmt.Println(string(responseData))
-	// return nil
-
 	return json.NewDecoder(resp.Body).Decode(target)
 }
 
-func listJobCustomFields(auth AuthenticateResponse, target interface{}) error {
-	var bodyString = ""
+func listJobCustomFields(ctx context.Context, auth AuthenticateResponse, target interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
 
-	body := strings.NewReader(bodyString)
-	req, err := http.NewRequest("GET", moraviaJobCustomFieldsURL(), body)
+	req, err := http.NewRequestWithContext(ctx, "GET", moraviaJobCustomFieldsURL(), nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	authorization_value := "Bearer " + auth.Access_token
 	req.Header.Set("Authorization", authorization_value)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	// If you want to print out the JSON response
-	// responseData, sErr := ioutil.ReadAll(resp.Body)
-	// if sErr != nil {
-	//     log.Fatal(sErr)
-	// }
-	// fmt.Println(string(responseData))
-	// return nil
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list job custom fields: %s", resp.Status)
+	}
 
 	return json.NewDecoder(resp.Body).Decode(target)
 }
 
-// Will update if it exists, create if it doesn't
-func updateJobCustomFields(auth AuthenticateResponse, customFields JobCustomFields, target interface{}) error {
-	jobsToExistingCustomFields := make(map[int]map[string]*JobCustomField)
+// Existing custom fields per job, each job's listed once however many workers
+// ask for it. Safe for concurrent use.
+type existingCustomFieldCache struct {
+	auth AuthenticateResponse
+
+	mu   sync.Mutex
+	jobs map[int]*existingCustomFieldsEntry
+}
+
+type existingCustomFieldsEntry struct {
+	once   sync.Once
+	fields map[string]*JobCustomField
+	err    error
+}
+
+func newExistingCustomFieldCache(auth AuthenticateResponse) *existingCustomFieldCache {
+	return &existingCustomFieldCache{auth: auth, jobs: make(map[int]*existingCustomFieldsEntry)}
+}
+
+// The job's fields by customFieldKey. The map is shared, don't change it.
+func (cache *existingCustomFieldCache) get(ctx context.Context, jobId int) (map[string]*JobCustomField, error) {
+	cache.mu.Lock()
+	entry, ok := cache.jobs[jobId]
+	if !ok {
+		entry = &existingCustomFieldsEntry{}
+		cache.jobs[jobId] = entry
+	}
+	cache.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.fields = make(map[string]*JobCustomField)
+		// A dry run may not have a job yet, in which case everything is new
+		if jobId == 0 {
+			return
+		}
+		job := Job{}
+		job.Id = jobId
+
+		existingCustomFields := JobCustomFields{}
+		entry.err = listJobCustomFieldsForJob(ctx, cache.auth, job, &existingCustomFields)
+		for i, field := range existingCustomFields.Value {
+			entry.fields[customFieldKey(field)] = &existingCustomFields.Value[i]
+		}
+	})
+	return entry.fields, entry.err
+}
 
+// Will update if it exists, create if it doesn't. Fields whose value is already
+// current are left alone. With DryRun the change set is computed without applying it.
+// With Prune, existing fields that aren't in customFields are deleted or blanked.
+// Writes are done by a worker pool, the change set is in customFields order
+// whatever order they finish in, and has only the writes that succeeded.
+func updateJobCustomFields(ctx context.Context, auth AuthenticateResponse, customFields JobCustomFields, options CustomFieldSyncOptions) (CustomFieldChangeSet, error) {
+	changeSet := CustomFieldChangeSet{}
+	cache := newExistingCustomFieldCache(auth)
+	jobsToDesiredCustomFields := make(map[int]map[string]bool)
+	var jobIds []int
+	addJob := func(jobId int) {
+		if jobsToDesiredCustomFields[jobId] == nil {
+			jobsToDesiredCustomFields[jobId] = make(map[string]bool)
+			jobIds = append(jobIds, jobId)
+		}
+	}
 	for _, customField := range customFields.Value {
-		// Check to see if we have a map for the existing custom fields for this job yet
-		existingCustomFieldMap := jobsToExistingCustomFields[customField.HandoffId]
-		if existingCustomFieldMap == nil {
-			// Get the custom fields for this Job
-			job := Job{}
-			job.Id = customField.HandoffId
-
-			existingCustomFields := JobCustomFields{}
-			customErr := listJobCustomFieldsForJob(auth, job, &existingCustomFields)
-			if customErr != nil {
-				log.Fatal(customErr)
-			}
+		addJob(customField.HandoffId)
+	}
+	if options.Prune != "" {
+		for _, jobId := range options.PruneJobIds {
+			addJob(jobId)
+		}
+	}
 
-			existingCustomFieldMap = make(map[string]*JobCustomField)
-			for i, field := range existingCustomFields.Value {
-				existingCustomFieldMap[field.Name] = &existingCustomFields.Value[i]
+	// List every job's fields up front, in parallel
+	var loads []func(ctx context.Context) error
+	for _, jobId := range jobIds {
+		jobId := jobId
+		loads = append(loads, func(ctx context.Context) error {
+			_, err := cache.get(ctx, jobId)
+			return err
+		})
+	}
+	if err := joinErrors(runWorkers(ctx, concurrency(), loads)); err != nil {
+		return changeSet, err
+	}
+
+	// Each write records its change once it's done
+	type fieldWrite struct {
+		apply  func(ctx context.Context) error
+		record func(changeSet *CustomFieldChangeSet)
+	}
+	var writes []fieldWrite
+	applyWrites := func() error {
+		tasks := make([]func(ctx context.Context) error, len(writes))
+		for i, write := range writes {
+			tasks[i] = write.apply
+		}
+		errs := make([]error, len(writes))
+		if !options.DryRun {
+			errs = runWorkers(ctx, concurrency(), tasks)
+		}
+		for i, write := range writes {
+			if errs[i] == nil {
+				write.record(&changeSet)
 			}
-			jobsToExistingCustomFields[job.Id] = existingCustomFieldMap
 		}
+		writes = nil
+		return joinErrors(errs)
+	}
+
+	for _, customField := range customFields.Value {
+		customField := customField
+		existingCustomFieldMap, err := cache.get(ctx, customField.HandoffId)
+		if err != nil {
+			return changeSet, err
+		}
+		jobsToDesiredCustomFields[customField.HandoffId][customFieldKey(customField)] = true
 
 		// See if there is an existing custom field
-		existingCustomField := existingCustomFieldMap[customField.Name]
-		if existingCustomField != nil {
-			// Do an update
-			updatesOnly := JobCustomField{}
-			updatesOnly.Value = customField.Value
-
-			updateJobCustomField(auth, (*existingCustomField).CustomFieldId, updatesOnly, nil)
-		} else {
+		existingCustomField := existingCustomFieldMap[customFieldKey(customField)]
+		if existingCustomField == nil {
 			// Create the new field
-			createJobCustomField(auth, customField, &customField)
+			customField := withDefaultPermissions(customField)
+			writes = append(writes, fieldWrite{
+				apply: func(ctx context.Context) error {
+					return createJobCustomField(ctx, auth, customField, &customField)
+				},
+				record: func(changeSet *CustomFieldChangeSet) {
+					changeSet.Created = append(changeSet.Created, customField)
+				},
+			})
+			continue
+		}
+
+		internalPermissionChanged := customField.InternalPermission != "" && customField.InternalPermission != existingCustomField.InternalPermission
+		nonInternalPermissionChanged := customField.NonInternalPermission != "" && customField.NonInternalPermission != existingCustomField.NonInternalPermission
+		if existingCustomField.Value == customField.Value && !internalPermissionChanged && !nonInternalPermissionChanged {
+			writes = append(writes, fieldWrite{
+				apply: func(ctx context.Context) error { return nil },
+				record: func(changeSet *CustomFieldChangeSet) {
+					changeSet.Unchanged = append(changeSet.Unchanged, *existingCustomField)
+				},
+			})
+			continue
+		}
+
+		// Do an update
+		updatesOnly := JobCustomFieldPatch{}
+		updatesOnly.Value = customField.Value
+		if internalPermissionChanged {
+			updatesOnly.InternalPermission = customField.InternalPermission
 		}
+		if nonInternalPermissionChanged {
+			updatesOnly.NonInternalPermission = customField.NonInternalPermission
+		}
+
+		change := CustomFieldChange{}
+		change.Field = *existingCustomField
+		change.OldValue = existingCustomField.Value
+		change.NewValue = customField.Value
+		change.NewInternalPermission = CustomFieldPermission(firstNonEmpty(string(customField.InternalPermission), string(existingCustomField.InternalPermission)))
+		change.NewNonInternalPermission = CustomFieldPermission(firstNonEmpty(string(customField.NonInternalPermission), string(existingCustomField.NonInternalPermission)))
+		writes = append(writes, fieldWrite{
+			apply: func(ctx context.Context) error {
+				return updateJobCustomField(ctx, auth, existingCustomField.CustomFieldId, updatesOnly, nil)
+			},
+			record: func(changeSet *CustomFieldChangeSet) {
+				changeSet.Updated = append(changeSet.Updated, change)
+			},
+		})
+	}
+	if err := applyWrites(); err != nil {
+		return changeSet, err
 	}
 
-	return nil
+	if options.Prune == "" {
+		return changeSet, nil
+	}
+	changeSet.PruneMode = options.Prune
+
+	for _, jobId := range jobIds {
+		existingCustomFieldMap, err := cache.get(ctx, jobId)
+		if err != nil {
+			return changeSet, err
+		}
+		var keys []string
+		for key := range existingCustomFieldMap {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			existingCustomField := existingCustomFieldMap[key]
+			if jobsToDesiredCustomFields[jobId][key] || isProtectedCustomField(*existingCustomField, options.Protected) {
+				continue
+			}
+			if options.Prune == PruneBlank && existingCustomField.Value == "" {
+				continue
+			}
+
+			writes = append(writes, fieldWrite{
+				apply: func(ctx context.Context) error {
+					if options.Prune == PruneDelete {
+						return deleteJobCustomField(ctx, auth, existingCustomField.CustomFieldId)
+					}
+					// The patch always carries Value, a JobCustomField would send {} and blank nothing
+					return updateJobCustomField(ctx, auth, existingCustomField.CustomFieldId, JobCustomFieldPatch{Value: ""}, nil)
+				},
+				record: func(changeSet *CustomFieldChangeSet) {
+					changeSet.Pruned = append(changeSet.Pruned, *existingCustomField)
+				},
+			})
+		}
+	}
+
+	return changeSet, applyWrites()
 }
 
-func updateJobCustomField(auth AuthenticateResponse, fieldId int, customField JobCustomField, target interface{}) error {
-	// customFieldJSON, _ := json.Marshal(customField)
-	// fmt.Println(string(customFieldJSON))
+func updateJobCustomField(ctx context.Context, auth AuthenticateResponse, fieldId int, patch JobCustomFieldPatch, target interface{}) error {
+	release, err := acquireWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
 
 	body := new(bytes.Buffer)
-	json.NewEncoder(body).Encode(customField)
+	json.NewEncoder(body).Encode(patch)
 
 	url := moraviaJobCustomFieldsURL() + "(" + strconv.Itoa(fieldId) + ")"
-	req, err := http.NewRequest("PATCH", url, body)
+	req, err := http.NewRequestWithContext(ctx, "PATCH", url, body)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	authorization_value := "Bearer " + auth.Access_token
@@ -439,40 +574,40 @@ func updateJobCustomField(auth AuthenticateResponse, fieldId int, customField Jo
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 200 {
-		fmt.Println("Updated job custom field " + strconv.Itoa(fieldId))
+		logs.Info("Updated job custom field", "id", fieldId)
 	} else if resp.StatusCode == 204 {
-		fmt.Println("Updated job custom field " + strconv.Itoa(fieldId) + ". No content.")
+		logs.Info("Updated job custom field", "id", fieldId)
 	} else {
-		fmt.Println("Failed to update job custom field " + strconv.Itoa(fieldId))
-		fmt.Println(resp)
+		return fmt.Errorf("failed to update job custom field %d: %s", fieldId, resp.Status)
 	}
 
-	// If you want to print out the JSON response
-	// responseData, sErr := ioutil.ReadAll(resp.Body)
-	// if sErr != nil {
-	//     log.Fatal(sErr)
-	// }
-	// fmt.Println(string(responseData))
-	// return nil
+	if target == nil || resp.StatusCode == 204 {
+		return nil
+	}
 
 	return json.NewDecoder(resp.Body).Decode(target)
 }
 
-func createJobCustomField(auth AuthenticateResponse, customField JobCustomField, target interface{}) error {
-	// customFieldJSON, _ := json.Marshal(customField)
-	// fmt.Println(string(customFieldJSON))
+func createJobCustomField(ctx context.Context, auth AuthenticateResponse, customField JobCustomField, target interface{}) error {
+	release, err := acquireWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
 
 	body := new(bytes.Buffer)
 	json.NewEncoder(body).Encode(customField)
 
-	req, err := http.NewRequest("POST", moraviaJobCustomFieldsURL(), body)
+	req, err := http.NewRequestWithContext(ctx, "POST", moraviaJobCustomFieldsURL(), body)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	authorization_value := "Bearer " + auth.Access_token
@@ -480,47 +615,68 @@ func createJobCustomField(auth AuthenticateResponse, customField JobCustomField,
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 201 {
-		fmt.Println("Created job custom field \"" + customField.Name + "\"")
+		logs.Info("Created job custom field", "name", customField.Name)
 	} else {
-		fmt.Println("Failed to create job custom field \"" + customField.Name + "\"")
-		fmt.Println(resp)
+		return fmt.Errorf("failed to create job custom field \"%s\": %s", customField.Name, resp.Status)
 	}
 
-	// If you want to print out the JSON response
-	// responseData, sErr := ioutil.ReadAll(resp.Body)
-	// if sErr != nil {
-	//     log.Fatal(sErr)
-	// }
-	// fmt.Println(string(responseData))
-	// return nil
-
 	return json.NewDecoder(resp.Body).Decode(target)
 }
 
+func deleteJobCustomField(ctx context.Context, auth AuthenticateResponse, fieldId int) error {
+	release, err := acquireWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	url := moraviaJobCustomFieldsURL() + "(" + strconv.Itoa(fieldId) + ")"
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	authorization_value := "Bearer " + auth.Access_token
+	req.Header.Set("Authorization", authorization_value)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 || resp.StatusCode == 204 {
+		logs.Info("Deleted job custom field", "id", fieldId)
+	} else {
+		return fmt.Errorf("failed to delete job custom field %d: %s", fieldId, resp.Status)
+	}
+
+	return nil
+}
+
 type Attachment struct {
+	Id                 int `json:",omitempty"`
 	JobId              int
 	Name               string
-	FileType           string // Values - "Other", "Reference", "Source", "Target", "Analysis"
-	AttachmentFilePath string `json:"-"`
+	FileType           string                 // Values - "Other", "Reference", "Source", "Target", "Analysis"
+	AttachmentFilePath string                 `json:"-"`
+	CreatedAt          *MoraviaDateTimeOffset `json:",omitempty"`
 }
 
 // https://stackoverflow.com/questions/20205796/post-data-using-the-content-type-multipart-form-data
-func mustOpen(filePath string) *os.File {
-	fileReader, err := os.Open(filePath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return fileReader
-}
+// The created resource is decoded into target, if there is one
+func upload(ctx context.Context, client *http.Client, url string, auth AuthenticateResponse, values map[string]io.Reader, target interface{}) (err error) {
+	ctx, cancel := uploadContext(ctx)
+	defer cancel()
 
-func upload(client *http.Client, url string, auth AuthenticateResponse, values map[string]io.Reader) (err error) {
 	// Prepare a form that you will submit to that URL.
-	print("Uploading...\n")
+	logs.Info("Uploading", "url", url)
 	var b bytes.Buffer
 	w := multipart.NewWriter(&b)
 	for key, r := range values {
@@ -549,7 +705,7 @@ func upload(client *http.Client, url string, auth AuthenticateResponse, values m
 	w.Close()
 
 	// Now that you have a form, you can submit it to your handler.
-	req, err := http.NewRequest("POST", url, &b)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, &b)
 	if err != nil {
 		return
 	}
@@ -559,61 +715,78 @@ func upload(client *http.Client, url string, auth AuthenticateResponse, values m
 	authorization_value := "Bearer " + auth.Access_token
 	req.Header.Set("Authorization", authorization_value)
 
+	release, err := acquireWrite(ctx)
+	if err != nil {
+		return
+	}
+	defer release()
+
 	// Submit the request
 	res, err := client.Do(req)
 	if err != nil {
 		return
 	}
+	defer res.Body.Close()
 
 	// Check the response
 	if res.StatusCode != http.StatusCreated {
 		err = fmt.Errorf("bad status: %s", res.Status)
+		return
 	}
-	return
+	// The upload worked even if the created resource can't be read, target is left as is
+	contents, err := ioutil.ReadAll(res.Body)
+	if err != nil || len(bytes.TrimSpace(contents)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(contents, target); err != nil {
+		logs.Warn("Couldn't read the uploaded attachment's id: " + err.Error())
+	}
+	return nil
 }
 
-func uploadAttachment(attachment Attachment, auth AuthenticateResponse) {
+func uploadAttachment(ctx context.Context, attachment Attachment, auth AuthenticateResponse) (Attachment, error) {
 	//
 	// { JobId: 37, Name: "TestData.txt", FileType: "Other"}
 
+	file, err := os.Open(attachment.AttachmentFilePath)
+	if err != nil {
+		return attachment, err
+	}
+
 	jsonData := new(bytes.Buffer)
 	json.NewEncoder(jsonData).Encode(attachment)
 
 	values := map[string]io.Reader{
-		"file": mustOpen(attachment.AttachmentFilePath),
+		"file": file,
 		"json": jsonData,
 	}
-	err := upload(httpClient, moraviaJobAttachmentsURL(), auth, values)
-	if err != nil {
-		log.Fatal(err)
-	}
+	created := attachment
+	err = upload(ctx, httpClient, moraviaJobAttachmentsURL(), auth, values, &created)
+	return created, err
 }
 
-func listJobAttachments(auth AuthenticateResponse) {
-	var bodyString = ""
+func listJobAttachments(ctx context.Context, auth AuthenticateResponse, target interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
 
-	body := strings.NewReader(bodyString)
-	req, err := http.NewRequest("GET", moraviaJobAttachmentsURL(), body)
+	req, err := http.NewRequestWithContext(ctx, "GET", moraviaJobAttachmentsURL(), nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	// req.Header.Set("Content-Type", "application/json")
 	authorization_value := "Bearer " + auth.Access_token
 	req.Header.Set("Authorization", authorization_value)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	responseData, sErr := ioutil.ReadAll(resp.Body)
-	if sErr != nil {
-
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list job attachments: %s", resp.Status)
 	}
-	fmt.Println(string(responseData))
 
-	// return json.NewDecoder(resp.Body).Decode(target)
+	return json.NewDecoder(resp.Body).Decode(target)
 }
 
 type Project struct {
@@ -627,227 +800,426 @@ type Projects struct {
 	Value []Project `json:"value"`
 }
 
-func findProject(name string, auth AuthenticateResponse, target interface{}) error {
-	var bodyString = ""
-
-	body := strings.NewReader(bodyString)
-
-	// https://projects.moravia.com/api/V3/Jobs?$filter=State eq Moravia.Symfonie.Data.JobState'Order'
+// Projects with name in theirs
+func findProject(ctx context.Context, name string, auth AuthenticateResponse, target interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
 
-	projectSearchURL := moraviaProjectsURL() + "?$filter=contains(Name, '" + name + "')"
-	// projectSearchURL := moraviaProjectsURL + "?$filter=Id eq 439741"
-	fmt.Println(projectSearchURL)
-
-	req, err := http.NewRequest("GET", projectSearchURL, body)
+	searchURL := moraviaProjectsURL() + "?$filter=" + odataQueryEscape("contains(Name, "+odataString(name)+")")
+	req, err := http.NewRequestWithContext(ctx, "GET", searchURL, nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	// req.Header.Set("Content-Type", "application/json")
 	authorization_value := "Bearer " + auth.Access_token
 	req.Header.Set("Authorization", authorization_value)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	responseData, sErr := ioutil.ReadAll(resp.Body)
-	if sErr != nil {
-		log.Fatal(sErr)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to find project %q: %s", name, resp.Status)
 	}
-	fmt.Println(string(responseData))
-
-	return nil
 
-	// return json.NewDecoder(resp.Body).Decode(target)
+	return json.NewDecoder(resp.Body).Decode(target)
 }
 
-func listProjects(auth AuthenticateResponse, target interface{}) error {
-	var bodyString = ""
+func listProjects(ctx context.Context, auth AuthenticateResponse, target interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
 
-	body := strings.NewReader(bodyString)
-	req, err := http.NewRequest("GET", moraviaProjectsURL(), body)
+	req, err := http.NewRequestWithContext(ctx, "GET", moraviaProjectsURL(), nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	// req.Header.Set("Content-Type", "application/json")
 	authorization_value := "Bearer " + auth.Access_token
 	req.Header.Set("Authorization", authorization_value)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list projects: %s", resp.Status)
+	}
+
 	return json.NewDecoder(resp.Body).Decode(target)
 }
 
-////
+// A quoted OData string literal, quotes inside are doubled
+func odataString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
 
-func exampleListProjectsJobs(auth AuthenticateResponse) {
-	projects := Projects{}
-	listProjects(auth, &projects)
+// Moravia wants %20 for spaces in a $filter, not +
+func odataQueryEscape(query string) string {
+	return strings.ReplaceAll(url.QueryEscape(query), "+", "%20")
+}
 
-	fmt.Println(projects)
+// The step inputs win over the credentials file profile, see loadCredentialsProfile
+func authenticateFromEnvironment(ctx context.Context) AuthenticateResponse {
+	clientID := getenv("moravia_client_id", "")
+	clientSecret := getenv("moravia_client_secret", "")
+	serviceAccount := getenv("moravia_service_account", "")
+	if isReplayingHAR() {
+		// Recordings are redacted, the credentials don't matter
+		clientID = firstNonEmpty(clientID, "replay")
+		clientSecret = firstNonEmpty(clientSecret, "replay")
+		serviceAccount = firstNonEmpty(serviceAccount, "replay")
+	}
 
-	jobs := Jobs{}
-	listJobs(auth, &jobs)
+	// The credentials file is only read for inputs that aren't set, so a file
+	// a run doesn't need can't break it
+	if clientID == "" || clientSecret == "" || serviceAccount == "" {
+		profile, err := loadCredentialsProfile(moraviaEnvironment())
+		if err != nil {
+			logs.Fatal("Failed to read credentials: " + err.Error())
+		}
+		clientID = firstNonEmpty(clientID, profile.ClientID)
+		clientSecret = firstNonEmpty(clientSecret, profile.ClientSecret)
+		serviceAccount = firstNonEmpty(serviceAccount, profile.ServiceAccount)
+	}
 
-	fmt.Println(jobs)
-}
+	if clientID == "" {
+		logs.Fatal("Client ID is required")
+	}
 
-func exampleCreateJob(auth AuthenticateResponse) {
-	job := Job{}
-	job.Name = "Automation job"
-	job.ProjectId = 1
-	job.SourceLanguageCode = "en"
-	job.TargetLanguageCodes = []string{"de", "nl"}
-	createJob(job, auth, &job)
-}
+	if clientSecret == "" {
+		logs.Fatal("Client secret is required")
+	}
 
-func exampleUploadAttachment(source *string, auth AuthenticateResponse) {
-	attachment := Attachment{}
-	attachment.JobId = 1
-	attachment.Name = "en.xliff"
-	attachment.FileType = "Source"
-	attachment.AttachmentFilePath = *source
+	if serviceAccount == "" {
+		logs.Fatal("Service account is required")
+	}
+	registerSecret(clientSecret)
 
-	uploadAttachment(attachment, auth)
-}
+	auth := AuthenticateResponse{}
+	err := authenticate(ctx, clientID, clientSecret, serviceAccount, &auth)
+	if isCancelled(ctx, err) {
+		logs.Fatal("Cancelled while authenticating, nothing was submitted")
+	}
+	if err != nil {
+		logs.Fatal("Failed to authenticate with Moravia", "error", err)
+	}
+	if auth.Access_token == "" {
+		logs.Fatal("Failed to authenticate with Moravia, there's no access token in the response")
+	}
+	registerSecret(auth.Access_token)
 
-////
+	return auth
+}
 
 func main() {
-	moraviaConfigFilepath := getenv("moravia_config", "moravia.yml")
+	flag.StringVar(&credentialsProfile, "profile", "", "credentials file profile, instead of MORAVIA_PROFILE")
+	flag.Parse()
+
+	command := "submit"
+	var args []string
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+		args = flag.Args()[1:]
+	}
 
-	var configuration MoraviaConfiguration
-	configuration.readFromFile(moraviaConfigFilepath)
+	switch command {
+	case "submit":
+		runSubmitCommand(shutdownContext(), args)
+	case "custom-fields":
+		runCustomFieldsCommand(shutdownContext(), args)
+	case "config":
+		runConfigCommand(args)
+	default:
+		fmt.Println("Unknown command \"" + command + "\". Commands: submit, custom-fields, config")
+		os.Exit(2)
+	}
 
-	clientID := getenv("moravia_client_id", "")
-	clientSecret := getenv("moravia_client_secret", "")
-	serviceAccount := getenv("moravia_service_account", "")
+	os.Exit(0)
+}
 
-	if clientID == "" {
-		fmt.Println("Client ID is required\n")
-		os.Exit(1)
+// submit command: creates a job from each selected template. -resume finishes
+// the submission a killed run left in the journal.
+func runSubmitCommand(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("submit", flag.ExitOnError)
+	resume := flags.Bool("resume", getenv("moravia_resume", "false") == "true", "finish the last submission instead of starting a new one")
+	flags.Parse(args)
+
+	configuration := loadConfiguration()
+	templates := loadJobTemplates(configuration)
+
+	// Validate every template up front so bad configuration fails before any job is created
+	var templateCustomFields []JobCustomFields
+	for _, template := range templates {
+		customFields, err := validateJobTemplate(template)
+		if err != nil {
+			logs.Fatal("Job template \"" + template.Id + "\": " + err.Error())
+		}
+		templateCustomFields = append(templateCustomFields, customFields)
 	}
 
-	if clientSecret == "" {
-		fmt.Println("Client secret is required\n")
-		os.Exit(1)
+	dryRun := getenv("moravia_dry_run", "false") == "true"
+
+	auth := AuthenticateResponse{}
+	if !dryRun {
+		auth = authenticateFromEnvironment(ctx)
 	}
 
-	if serviceAccount == "" {
-		fmt.Println("Service account is required\n")
-		os.Exit(1)
+	var journal *submissionJournal
+	if !dryRun {
+		var err error
+		journal, err = openJournal(journalPath(), *resume)
+		if err != nil {
+			logs.Fatal(err.Error())
+		}
 	}
 
-	if configuration.Project.Id == 0 {
-		fmt.Println("Project ID is required\n")
-		os.Exit(1)
+	// Templates are submitted in parallel, see concurrency. After a failure, or
+	// if the run is cancelled, templates that haven't started aren't, and are
+	// reported as cancelled. Outputs and the report are still written, in
+	// template order.
+	submissions := make([]JobSubmission, len(templates))
+	var mu sync.Mutex
+	failed := false
+	var tasks []func(ctx context.Context) error
+	for i := range templates {
+		i := i
+		tasks = append(tasks, func(ctx context.Context) error {
+			mu.Lock()
+			stopped := failed
+			mu.Unlock()
+			if stopped {
+				return nil
+			}
+
+			template := templates[i]
+			submission, err := submitJobTemplate(ctx, template, templateCustomFields[i], auth, dryRun, journal)
+			if err != nil {
+				if submission.Status == "" {
+					submission.Status = JobFailed
+					submission.Error = redact(err.Error())
+				}
+				if isCancelled(ctx, err) {
+					submission.Status = JobCancelled
+				}
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+			submissions[i] = submission
+			if err != nil {
+				return fmt.Errorf("job template \"%s\": %s", template.Id, err)
+			}
+			return nil
+		})
+	}
+	errs := runWorkers(ctx, concurrency(), tasks)
+	for i, template := range templates {
+		if submissions[i].Template == "" {
+			submission := JobSubmission{Template: template.Id, Status: JobCancelled, Error: "not started"}
+			submission.Job.ProjectId = template.Project.Id
+			submission.Job.SourceLanguageCode = template.Source_language
+			submission.Job.TargetLanguageCodes = template.Target_languages
+			submissions[i] = submission
+			errs[i] = nil
+		}
+	}
+	if err := joinErrors(errs); err != nil {
+		logs.Error(err.Error())
 	}
 
-	if configuration.Job_template.Source == "" {
-		fmt.Println("Source is required\n")
+	exportStepOutputs(submissions)
+	if ctx.Err() != nil {
+		logs.Warn("Submission cancelled, see the report for what was done")
+	}
+	if failed || ctx.Err() != nil {
 		os.Exit(1)
 	}
+}
+
+// Checks a template and builds its custom fields, without a job
+func validateJobTemplate(template MoraviaJobTemplateConfiguration) (JobCustomFields, error) {
+	if template.Project.Id == 0 {
+		return JobCustomFields{}, fmt.Errorf("project ID is required")
+	}
+
+	if template.Source == "" {
+		return JobCustomFields{}, fmt.Errorf("source is required")
+	}
 	// Test opening the source
-	mustOpen(configuration.Job_template.Source)
+	sourceFile, err := os.Open(template.Source)
+	if err != nil {
+		return JobCustomFields{}, err
+	}
+	sourceFile.Close()
 
-	if configuration.Job_template.Source_language == "" {
-		fmt.Println("Source language is required\n")
-		os.Exit(1)
+	if template.Source_language == "" {
+		return JobCustomFields{}, fmt.Errorf("source language is required")
 	}
 
 	// TODO: Alex - need a check against target languages
 
-	auth := AuthenticateResponse{}
-	authenticate(clientID, clientSecret, serviceAccount, &auth)
-	if auth.Access_token == "" {
-		fmt.Println("Failed to authenticate with Moravia")
-		os.Exit(1)
+	pruning := template.Custom_field_pruning
+	if pruning != "" && pruning != PruneDelete && pruning != PruneBlank {
+		return JobCustomFields{}, fmt.Errorf("custom field pruning must be \"delete\" or \"blank\"")
 	}
-	// fmt.Println(auth)
 
-	// Debug the prod Job custom fields
-	// prodJob := Job{}
-	// prodJob.Id = 473158
-	//
-	// customFields := JobCustomFields{}
-	// customErr := listJobCustomFieldsForJob(auth, prodJob, &customFields)
-	// if customErr != nil {
-	//     log.Fatal(customErr)
-	// }
-	//
-	// customFieldJSON, _ := json.Marshal(customFields)
-	// fmt.Println(string(customFieldJSON))
-	// os.Exit(0)
+	return jobCustomFieldsFromTemplate(template, Job{})
+}
 
-	currentTime := time.Now()
-	// Golang wat - https://gobyexample.com/time-formatting-parsing
-	dateString := currentTime.Format("20060102")
+// Creates the job for a template, sets its custom fields and uploads the source,
+// recording each step in the journal. Steps the journal already has are skipped,
+// so a resumed submission reuses its job. If anything fails after the job is
+// created, the job is rolled back.
+func submitJobTemplate(ctx context.Context, template MoraviaJobTemplateConfiguration, customFields JobCustomFields, auth AuthenticateResponse, dryRun bool, journal *submissionJournal) (JobSubmission, error) {
+	submission := JobSubmission{}
+	submission.Template = template.Id
 
-	job := Job{}
-	job.Name = dateString + " - " + configuration.Job_template.Name
-	job.ProjectId = configuration.Project.Id
-	job.SourceLanguageCode = configuration.Job_template.Source_language
-	job.TargetLanguageCodes = configuration.Job_template.Target_languages
-	err := createJob(job, auth, &job)
+	jobName, jobDescription, err := renderJobText(template, time.Now())
 	if err != nil {
-		log.Fatal(err)
+		return submission, err
 	}
 
-	fmt.Println(job)
+	job := Job{}
+	job.Name = jobName
+	job.Description = jobDescription
+	job.ProjectId = template.Project.Id
+	job.SourceLanguageCode = template.Source_language
+	job.TargetLanguageCodes = template.Target_languages
+
+	entry := journal.entry(template.Id)
+	if entry != nil && entry.Job.Id != 0 && entry.Job.ProjectId != job.ProjectId {
+		logs.Warn("Not resuming job template \"" + template.Id + "\", its project changed")
+		entry = nil
+	}
+	if entry == nil {
+		entry = &journalEntry{}
+	}
 
-	// Update the job custom fields
-	customFields := JobCustomFields{}
-	for _, fieldConfig := range configuration.Job_template.Custom_fields {
-		customField := JobCustomField{}
-		customField.Group = fieldConfig.Group
-		customField.Name = fieldConfig.Name
-		customField.DefinitionKey = fieldConfig.Name
-		customField.InternalPermission = "Edit"
-		customField.NonInternalPermission = "Edit"
-		customField.DefinitionFormatter = fieldConfig.Type
-		customField.DefinitionAdditionalData = strings.Join(fieldConfig.Choices[:], ",")
-		customField.IsLanguageSpecific = fieldConfig.Is_language_specific
-		customField.Value = strings.Join(fieldConfig.Value[:], ",")
-		customField.HandoffId = job.Id
+	status := JobCreated
+	if dryRun {
+		logs.Info("Dry run, not creating job", "name", job.Name)
+	} else if entry.Job.Id != 0 {
+		job = entry.Job
+		status = JobReused
+		logs.Info("Resuming job", "id", job.Id, "name", job.Name)
+	} else {
+		created := job
+		err := createJob(ctx, job, auth, &created)
+		if unreadable, ok := err.(unreadableJobError); ok {
+			created, err = findCreatedJob(auth, job)
+			if err != nil {
+				logs.Error("Job was created but couldn't be found, it's left in Moravia", "name", job.Name, "project", job.ProjectId, "error", err)
+				submission.Job = job
+				submission.Status = JobFailed
+				submission.Error = redact(unreadable.Error())
+				submission.Rollback = redact(fmt.Sprintf("job \"%s\" is left in project %d, it couldn't be found to roll back: %s", job.Name, job.ProjectId, err))
+				return submission, unreadable
+			}
+			logs.Warn("Couldn't read the created job, found it by name", "id", created.Id, "name", created.Name)
+		}
+		if err != nil {
+			return submission, err
+		}
+		job = created
+		journal.update(template.Id, func(entry *journalEntry) { entry.Job = job })
+	}
+	submission.Job = job
 
-		customFields.Value = append(customFields.Value, customField)
+	if entry.Completed {
+		logs.Info("Job template \"" + template.Id + "\" was already submitted")
+		submission.Status = JobReused
+		for _, attachment := range entry.Attachments {
+			submission.Attachments = append(submission.Attachments, Attachment{Id: attachment.Id, JobId: job.Id, Name: attachment.Name, AttachmentFilePath: attachment.Path})
+		}
+		submission.DetailURL = moraviaPortalJobDetailsURL(job)
+		return submission, nil
 	}
-	customFieldErr := updateJobCustomFields(auth, customFields, nil)
-	if customFieldErr != nil {
-		log.Fatal(customFieldErr)
+
+	fail := func(err error) (JobSubmission, error) {
+		submission.Status = JobFailed
+		submission.Error = redact(err.Error())
+		if !dryRun {
+			rollback, resolved := rollbackJob(auth, template, job, err)
+			submission.Rollback = rollback
+			if resolved {
+				journal.remove(template.Id)
+			}
+		}
+		return submission, err
 	}
 
-	_, filename := filepath.Split(configuration.Job_template.Source)
+	logs.Info("Job", "name", job.Name, "project", job.ProjectId, "source", job.SourceLanguageCode, "targets", strings.Join(job.TargetLanguageCodes, ","))
+
+	// Update the job custom fields
+	for i := range customFields.Value {
+		customFields.Value[i].HandoffId = job.Id
+	}
+	options := CustomFieldSyncOptions{}
+	options.DryRun = dryRun
+	options.Prune = template.Custom_field_pruning
+	options.Protected = template.Protected_custom_fields
+	if job.Id != 0 {
+		options.PruneJobIds = []int{job.Id}
+	}
+	if entry.CustomFieldsDone {
+		logs.Info("Custom fields were already set", "fields", strings.Join(entry.CustomFields, ", "))
+	} else {
+		changeSet, err := updateJobCustomFields(ctx, auth, customFields, options)
+		submission.CustomFields = changeSet
+		if err != nil {
+			return fail(err)
+		}
+		var changes bytes.Buffer
+		changeSet.Print(&changes)
+		logs.Info("Custom fields\n" + strings.TrimRight(changes.String(), "\n"))
+
+		journal.update(template.Id, func(entry *journalEntry) {
+			entry.CustomFieldsDone = true
+			entry.CustomFields = nil
+			for _, field := range changeSet.Created {
+				entry.CustomFields = append(entry.CustomFields, customFieldKey(field))
+			}
+			for _, change := range changeSet.Updated {
+				entry.CustomFields = append(entry.CustomFields, customFieldKey(change.Field))
+			}
+		})
+	}
+
+	_, filename := filepath.Split(template.Source)
 
 	attachment := Attachment{}
 	attachment.JobId = job.Id
 	attachment.Name = filename
 	attachment.FileType = "Source"
-	attachment.AttachmentFilePath = configuration.Job_template.Source
-
-	uploadAttachment(attachment, auth)
+	attachment.AttachmentFilePath = template.Source
 
-	portalURL := moraviaPortalJobDetailsURL(job)
-
-	fmt.Println(portalURL)
+	if dryRun {
+		logs.Info("Dry run, not uploading", "file", template.Source)
+		submission.Status = JobSkipped
+		submission.Attachments = append(submission.Attachments, attachment)
+		return submission, nil
+	}
 
-	//
-	// --- Step Outputs: Export Environment Variables for other Steps:
-	// You can export Environment Variables for other Steps with
-	//  envman, which is automatically installed by `bitrise setup`.
-	// A very simple example:
-	cmdLog, err := exec.Command("bitrise", "envman", "add", "--key", "MORAVIA_JOB_DETAIL_URL", "--value", portalURL).CombinedOutput()
-	if err != nil {
-		fmt.Printf("Failed to expose output with envman, error: %#v | output: %s", err, cmdLog)
+	if len(entry.Attachments) > 0 {
+		attachment.Id = entry.Attachments[0].Id
+		logs.Info("Source was already uploaded", "attachment", attachment.Id)
+	} else {
+		attachment, err = uploadAttachment(ctx, attachment, auth)
+		if err != nil {
+			return fail(err)
+		}
+		journal.update(template.Id, func(entry *journalEntry) {
+			entry.Attachments = append(entry.Attachments, journalAttachment{attachment.Id, attachment.Name, attachment.AttachmentFilePath})
+		})
 	}
-	// You can find more usage examples on envman's GitHub page
-	//  at: https://github.com/bitrise-io/envman
+	submission.Attachments = append(submission.Attachments, attachment)
+	journal.update(template.Id, func(entry *journalEntry) { entry.Completed = true })
 
-	os.Exit(0)
+	submission.Status = status
+	submission.DetailURL = moraviaPortalJobDetailsURL(job)
+	logs.Info("Job detail", "url", submission.DetailURL)
+
+	return submission, nil
 }
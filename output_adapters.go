@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Where step outputs go: envman on Bitrise, $GITHUB_OUTPUT on GitHub Actions
+// and so on. Adapters without a summary page ignore the summary.
+type outputAdapter interface {
+	Name() string
+	SetOutputs(outputs []stepOutput) error
+	WriteSummary(markdown string) error
+}
+
+// The moravia_output adapter, or the CI one detected from the environment plus
+// a file adapter if moravia_output_file is set
+func outputAdapters() ([]outputAdapter, error) {
+	file := getenv("moravia_output_file", "")
+
+	switch name := getenv("moravia_output", "auto"); name {
+	case "auto":
+		adapters := []outputAdapter{detectOutputAdapter()}
+		if file != "" {
+			adapters = append(adapters, fileOutputAdapter{Path: file})
+		}
+		return adapters, nil
+	case "envman":
+		return []outputAdapter{envmanOutputAdapter{}}, nil
+	case "github":
+		return []outputAdapter{githubOutputAdapter{OutputPath: os.Getenv("GITHUB_OUTPUT"), SummaryPath: os.Getenv("GITHUB_STEP_SUMMARY")}}, nil
+	case "gitlab":
+		return []outputAdapter{gitlabOutputAdapter{Path: getenv("moravia_dotenv_file", "moravia.env")}}, nil
+	case "file":
+		if file == "" {
+			return nil, fmt.Errorf("moravia_output is file but moravia_output_file isn't set")
+		}
+		return []outputAdapter{fileOutputAdapter{Path: file}}, nil
+	case "stdout":
+		return []outputAdapter{stdoutOutputAdapter{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown moravia_output \"%s\", expected auto, envman, github, gitlab, file or stdout", name)
+	}
+}
+
+func detectOutputAdapter() outputAdapter {
+	switch {
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		return githubOutputAdapter{OutputPath: os.Getenv("GITHUB_OUTPUT"), SummaryPath: os.Getenv("GITHUB_STEP_SUMMARY")}
+	case os.Getenv("GITLAB_CI") == "true":
+		return gitlabOutputAdapter{Path: getenv("moravia_dotenv_file", "moravia.env")}
+	case os.Getenv("BITRISE_BUILD_NUMBER") != "" || os.Getenv("ENVMAN_ENVSTORE_PATH") != "":
+		return envmanOutputAdapter{}
+	}
+	if _, err := exec.LookPath("bitrise"); err == nil {
+		return envmanOutputAdapter{}
+	}
+	return stdoutOutputAdapter{}
+}
+
+// bitrise envman add, see https://github.com/bitrise-io/envman
+type envmanOutputAdapter struct{}
+
+func (envmanOutputAdapter) Name() string { return "envman" }
+
+func (envmanOutputAdapter) SetOutputs(outputs []stepOutput) error {
+	for _, output := range outputs {
+		cmdLog, err := exec.Command("bitrise", "envman", "add", "--key", output.Key, "--value", output.Value).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("envman add %s: %s: %s", output.Key, err, strings.TrimSpace(string(cmdLog)))
+		}
+	}
+	return nil
+}
+
+// The deploy directory has the summary file instead
+func (envmanOutputAdapter) WriteSummary(markdown string) error { return nil }
+
+// https://docs.github.com/en/actions/using-workflows/workflow-commands-for-github-actions
+type githubOutputAdapter struct {
+	OutputPath  string // $GITHUB_OUTPUT
+	SummaryPath string // $GITHUB_STEP_SUMMARY
+}
+
+func (githubOutputAdapter) Name() string { return "github" }
+
+func (adapter githubOutputAdapter) SetOutputs(outputs []stepOutput) error {
+	if adapter.OutputPath == "" {
+		return fmt.Errorf("GITHUB_OUTPUT isn't set")
+	}
+	var contents strings.Builder
+	for _, output := range outputs {
+		if !strings.Contains(output.Value, "\n") {
+			fmt.Fprintf(&contents, "%s=%s\n", output.Key, output.Value)
+			continue
+		}
+		// Multiline values need a delimiter that isn't in the value
+		delimiter := "MORAVIA_EOF_" + randomHex(8)
+		fmt.Fprintf(&contents, "%s<<%s\n%s\n%s\n", output.Key, delimiter, output.Value, delimiter)
+	}
+	return appendToFile(adapter.OutputPath, contents.String())
+}
+
+func (adapter githubOutputAdapter) WriteSummary(markdown string) error {
+	if adapter.SummaryPath == "" {
+		return nil
+	}
+	return appendToFile(adapter.SummaryPath, markdown+"\n")
+}
+
+// A dotenv report, which the job declares with
+//
+//	artifacts:
+//	  reports:
+//	    dotenv: moravia.env
+//
+// dotenv values can't span lines, so lines are joined with ", ".
+type gitlabOutputAdapter struct {
+	Path string
+}
+
+func (gitlabOutputAdapter) Name() string { return "gitlab" }
+
+func (adapter gitlabOutputAdapter) SetOutputs(outputs []stepOutput) error {
+	var contents strings.Builder
+	for _, output := range outputs {
+		fmt.Fprintf(&contents, "%s=%s\n", output.Key, strings.Replace(output.Value, "\n", ", ", -1))
+	}
+	return ioutil.WriteFile(adapter.Path, []byte(contents.String()), 0644)
+}
+
+// GitLab has no job summary page
+func (gitlabOutputAdapter) WriteSummary(markdown string) error { return nil }
+
+// KEY=value lines, or a JSON object if the path ends in .json. Values with
+// newlines are quoted in KEY=value files. The summary goes next to it as .md.
+type fileOutputAdapter struct {
+	Path string
+}
+
+func (fileOutputAdapter) Name() string { return "file" }
+
+func (adapter fileOutputAdapter) SetOutputs(outputs []stepOutput) error {
+	if filepath.Ext(adapter.Path) == ".json" {
+		values := make(map[string]string)
+		for _, output := range outputs {
+			values[output.Key] = output.Value
+		}
+		contents, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(adapter.Path, append(contents, '\n'), 0644)
+	}
+
+	var contents strings.Builder
+	for _, output := range outputs {
+		value := output.Value
+		if strings.ContainsAny(value, "\n\"") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&contents, "%s=%s\n", output.Key, value)
+	}
+	return ioutil.WriteFile(adapter.Path, []byte(contents.String()), 0644)
+}
+
+func (adapter fileOutputAdapter) WriteSummary(markdown string) error {
+	path := strings.TrimSuffix(adapter.Path, filepath.Ext(adapter.Path)) + ".md"
+	return ioutil.WriteFile(path, []byte(markdown+"\n"), 0644)
+}
+
+// Running locally, outputs are only printed
+type stdoutOutputAdapter struct{}
+
+func (stdoutOutputAdapter) Name() string { return "stdout" }
+
+func (stdoutOutputAdapter) SetOutputs(outputs []stepOutput) error {
+	for _, output := range outputs {
+		logs.Info(output.Key + "=" + output.Value)
+	}
+	return nil
+}
+
+func (stdoutOutputAdapter) WriteSummary(markdown string) error { return nil }
+
+func appendToFile(path string, contents string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobSkipped   JobStatus = "skipped" // Dry run
+	JobCreated   JobStatus = "created"
+	JobReused    JobStatus = "reused"    // Created by an earlier run
+	JobFailed    JobStatus = "failed"    // See Error and Rollback
+	JobCancelled JobStatus = "cancelled" // Interrupted, or never started
+)
+
+// What submitting a job template did
+type JobSubmission struct {
+	Template     string
+	Status       JobStatus
+	Job          Job
+	Attachments  []Attachment
+	DetailURL    string
+	CustomFields CustomFieldChangeSet
+	Error        string // Why it failed, redacted
+	Rollback     string // What was done about a failed job, see rollbackJob
+}
+
+// A step output, declared in step.yml
+type stepOutput struct {
+	Key   string
+	Value string
+}
+
+const summaryFileName = "moravia-summary.json"
+
+// The outputs of a run. With more than one job template, values are comma
+// separated in template order, except job names which are one per line.
+func stepOutputs(submissions []JobSubmission, summaryPath string) []stepOutput {
+	var detailURLs, jobIds, jobNames, projectIds, statuses, attachmentIds, targetLanguages []string
+	for _, submission := range submissions {
+		detailURLs = append(detailURLs, submission.DetailURL)
+		jobId := ""
+		if submission.Job.Id != 0 {
+			jobId = strconv.Itoa(submission.Job.Id)
+		}
+		jobIds = append(jobIds, jobId)
+		jobNames = append(jobNames, maskSecrets(submission.Job.Name))
+		projectIds = append(projectIds, strconv.Itoa(submission.Job.ProjectId))
+		statuses = append(statuses, string(submission.Status))
+		for _, attachment := range submission.Attachments {
+			if attachment.Id != 0 {
+				attachmentIds = append(attachmentIds, strconv.Itoa(attachment.Id))
+			}
+		}
+		for _, language := range submission.Job.TargetLanguageCodes {
+			if !containsString(targetLanguages, language) {
+				targetLanguages = append(targetLanguages, language)
+			}
+		}
+	}
+
+	return []stepOutput{
+		{"MORAVIA_JOB_DETAIL_URL", strings.Join(detailURLs, ",")},
+		{"MORAVIA_JOB_ID", strings.Join(jobIds, ",")},
+		{"MORAVIA_JOB_NAME", strings.Join(jobNames, "\n")},
+		{"MORAVIA_PROJECT_ID", strings.Join(projectIds, ",")},
+		{"MORAVIA_TARGET_LANGUAGES", strings.Join(targetLanguages, ",")},
+		{"MORAVIA_ATTACHMENT_IDS", strings.Join(attachmentIds, ",")},
+		{"MORAVIA_JOB_STATUS", strings.Join(statuses, ",")},
+		{"MORAVIA_SUMMARY_PATH", summaryPath},
+	}
+}
+
+type jobSummary struct {
+	Template        string    `json:"template"`
+	Status          JobStatus `json:"status"`
+	JobId           int       `json:"job_id,omitempty"`
+	JobName         string    `json:"job_name"`
+	ProjectId       int       `json:"project_id"`
+	SourceLanguage  string    `json:"source_language"`
+	TargetLanguages []string  `json:"target_languages"`
+	AttachmentIds   []int     `json:"attachment_ids"`
+	DetailURL       string    `json:"detail_url,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	Rollback        string    `json:"rollback,omitempty"`
+	CustomFields    struct {
+		Created   []string `json:"created"`
+		Updated   []string `json:"updated"`
+		Unchanged []string `json:"unchanged"`
+		Pruned    []string `json:"pruned"`
+	} `json:"custom_fields"`
+}
+
+// BITRISE_DEPLOY_DIR, or the temp directory outside Bitrise
+func deployDir() string {
+	return getenv("BITRISE_DEPLOY_DIR", os.TempDir())
+}
+
+// Writes a JSON summary of the run to the deploy directory and returns its path. Custom field values aren't included,
+// only their names.
+func writeSummary(submissions []JobSubmission) (string, error) {
+	summary := struct {
+		Environment string       `json:"environment"`
+		SubmittedAt time.Time    `json:"submitted_at"`
+		Jobs        []jobSummary `json:"jobs"`
+	}{Environment: moraviaEnvironment(), SubmittedAt: time.Now()}
+
+	for _, submission := range submissions {
+		job := jobSummary{}
+		job.Template = submission.Template
+		job.Status = submission.Status
+		job.JobId = submission.Job.Id
+		job.JobName = maskSecrets(submission.Job.Name)
+		job.ProjectId = submission.Job.ProjectId
+		job.SourceLanguage = submission.Job.SourceLanguageCode
+		job.TargetLanguages = submission.Job.TargetLanguageCodes
+		job.AttachmentIds = []int{}
+		for _, attachment := range submission.Attachments {
+			if attachment.Id != 0 {
+				job.AttachmentIds = append(job.AttachmentIds, attachment.Id)
+			}
+		}
+		job.DetailURL = submission.DetailURL
+		job.Error = submission.Error
+		job.Rollback = submission.Rollback
+
+		changeSet := submission.CustomFields
+		fieldNames := func(fields []JobCustomField) []string {
+			names := []string{}
+			for _, field := range fields {
+				names = append(names, customFieldKey(field))
+			}
+			return names
+		}
+		job.CustomFields.Created = fieldNames(changeSet.Created)
+		job.CustomFields.Unchanged = fieldNames(changeSet.Unchanged)
+		job.CustomFields.Pruned = fieldNames(changeSet.Pruned)
+		job.CustomFields.Updated = []string{}
+		for _, change := range changeSet.Updated {
+			job.CustomFields.Updated = append(job.CustomFields.Updated, customFieldKey(change.Field))
+		}
+
+		summary.Jobs = append(summary.Jobs, job)
+	}
+
+	contents, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(deployDir(), summaryFileName)
+	return path, ioutil.WriteFile(path, append(contents, '\n'), 0644)
+}
+
+// Writes the summary file and report, and sends the outputs and report to every
+// output adapter. Failing to export outputs fails the step, since later steps need them.
+func exportStepOutputs(submissions []JobSubmission) {
+	summaryPath, err := writeSummary(submissions)
+	if err != nil {
+		logs.Error("Failed to write summary: " + err.Error())
+		summaryPath = ""
+	}
+	outputs := stepOutputs(submissions, summaryPath)
+
+	adapters, err := outputAdapters()
+	if err != nil {
+		logs.Fatal(err.Error())
+	}
+	report := newReport(submissions)
+	if err := report.writeFiles(deployDir()); err != nil {
+		logs.Error("Failed to write report: " + err.Error())
+	}
+	markdown, err := report.Markdown()
+	if err != nil {
+		logs.Error("Failed to write report: " + err.Error())
+	}
+	for _, adapter := range adapters {
+		if err := adapter.SetOutputs(outputs); err != nil {
+			logs.Fatal("Failed to export outputs with " + adapter.Name() + ": " + err.Error())
+		}
+		if err := adapter.WriteSummary(markdown); err != nil {
+			logs.Error("Failed to write summary with " + adapter.Name() + ": " + err.Error())
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retries of a request Moravia answered with 429 Too Many Requests
+const rateLimitRetries = 3
+
+// Token bucket in front of every request, so bulk commands stay under Moravia's
+// quotas instead of being throttled:
+//
+//	moravia_rate_limit            requests per second across all endpoints, 10 by default, 0 for none
+//	moravia_rate_limit_burst      requests that can go at once after a quiet spell, the rate by default
+//	moravia_endpoint_rate_limits  per endpoint requests per second, like "jobattachments=2,JobCustomFields=5"
+//
+// On a 429 the bucket slows down and pauses for Retry-After, then speeds back up
+// as requests succeed. The request is retried.
+type rateLimitTransport struct {
+	base      http.RoundTripper
+	global    *tokenBucket            // nil without a limit
+	endpoints map[string]*tokenBucket // By lower case endpoint name
+}
+
+func newRateLimitTransport(base http.RoundTripper) http.RoundTripper {
+	transport := &rateLimitTransport{base: base, endpoints: make(map[string]*tokenBucket)}
+
+	rate := rateFromEnvironment("moravia_rate_limit", getenv("moravia_rate_limit", "10"), 10)
+	if rate > 0 {
+		burst := rateFromEnvironment("moravia_rate_limit_burst", getenv("moravia_rate_limit_burst", ""), rate)
+		transport.global = newTokenBucket("all endpoints", rate, burst)
+	}
+
+	for _, limit := range strings.Split(getenv("moravia_endpoint_rate_limits", ""), ",") {
+		limit = strings.TrimSpace(limit)
+		if limit == "" {
+			continue
+		}
+		parts := strings.SplitN(limit, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			logs.Warn("Ignoring moravia_endpoint_rate_limits entry, expected endpoint=requests per second", "entry", limit)
+			continue
+		}
+		endpoint := strings.TrimSpace(parts[0])
+		rate := rateFromEnvironment("moravia_endpoint_rate_limits", parts[1], 0)
+		if rate > 0 {
+			transport.endpoints[strings.ToLower(endpoint)] = newTokenBucket(endpoint, rate, rate)
+		}
+	}
+	return transport
+}
+
+// value is requests per second, fallback if it's empty or bad
+func rateFromEnvironment(key string, value string, fallback float64) float64 {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fallback
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		logs.Warn("Ignoring "+key+", expected requests per second", "value", value)
+		return fallback
+	}
+	return rate
+}
+
+// The collection a URL is for, like Jobs for /Api/V4/Jobs(123) or token for
+// /connect/token
+func endpointName(req *http.Request) string {
+	name := path.Base(req.URL.Path)
+	if i := strings.Index(name, "("); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+func (transport *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := endpointName(req)
+	buckets := []*tokenBucket{}
+	if transport.global != nil {
+		buckets = append(buckets, transport.global)
+	}
+	// 429s slow down the endpoint's own bucket if it has one, otherwise every request
+	throttled := transport.global
+	if bucket, ok := transport.endpoints[strings.ToLower(endpoint)]; ok {
+		buckets = append(buckets, bucket)
+		throttled = bucket
+	}
+
+	for attempt := 0; ; attempt++ {
+		for _, bucket := range buckets {
+			if err := bucket.wait(req.Context()); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := transport.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			if err == nil && throttled != nil {
+				throttled.succeeded()
+			}
+			return resp, err
+		}
+
+		// The body has been sent, a retry needs a fresh one
+		if attempt == rateLimitRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Second<<uint(attempt))
+		resp.Body.Close()
+		logs.Warn("Moravia is throttling requests, slowing down", "endpoint", endpoint, "retry_after", retryAfter)
+		if throttled != nil {
+			throttled.throttle(retryAfter)
+		} else if err := sleepContext(req.Context(), retryAfter); err != nil {
+			return nil, err
+		}
+
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			retry.Body = body
+		}
+		req = retry
+	}
+}
+
+// Seconds or an HTTP date, fallback if it's missing or bad
+func parseRetryAfter(value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return fallback
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Refills at rate tokens per second up to burst. After a throttle the rate
+// is halved, down to a sixteenth of the configured one, and comes back a
+// twentieth at a time with each request that isn't throttled.
+type tokenBucket struct {
+	name           string
+	configuredRate float64
+	burst          float64
+
+	mu          sync.Mutex
+	rate        float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func newTokenBucket(name string, rate float64, burst float64) *tokenBucket {
+	burst = math.Max(1, burst)
+	return &tokenBucket{name: name, configuredRate: rate, burst: burst, rate: rate, tokens: burst, last: time.Now()}
+}
+
+// Waits for a token, or until ctx is done
+func (bucket *tokenBucket) wait(ctx context.Context) error {
+	for {
+		delay := bucket.take(time.Now())
+		if delay == 0 {
+			return nil
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// Takes a token and returns 0, or returns how long until there may be one
+func (bucket *tokenBucket) take(now time.Time) time.Duration {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	if now.Before(bucket.pausedUntil) {
+		return bucket.pausedUntil.Sub(now)
+	}
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+func (bucket *tokenBucket) throttle(retryAfter time.Duration) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	bucket.rate = math.Max(bucket.configuredRate/16, bucket.rate/2)
+	bucket.tokens = 0
+	if until := time.Now().Add(retryAfter); until.After(bucket.pausedUntil) {
+		bucket.pausedUntil = until
+		bucket.last = until
+	}
+	logs.Debug("Rate limit lowered", "bucket", bucket.name, "rate", strconv.FormatFloat(bucket.rate, 'f', 2, 64))
+}
+
+func (bucket *tokenBucket) succeeded() {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	if bucket.rate < bucket.configuredRate {
+		bucket.rate = math.Min(bucket.configuredRate, bucket.rate+bucket.configuredRate/20)
+	}
+}
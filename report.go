@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Warnings from the whole run, shown at the end of the report
+var runWarnings struct {
+	sync.Mutex
+	messages []string
+}
+
+func warn(message string) {
+	message = redact(message)
+	logs.Warn(message)
+	runWarnings.Lock()
+	runWarnings.messages = append(runWarnings.messages, message)
+	runWarnings.Unlock()
+}
+
+func collectedWarnings() []string {
+	runWarnings.Lock()
+	defer runWarnings.Unlock()
+	return append([]string(nil), runWarnings.messages...)
+}
+
+const (
+	reportMarkdownFileName = "moravia-report.md"
+	reportHTMLFileName     = "moravia-report.html"
+)
+
+type reportData struct {
+	Environment string
+	GeneratedAt time.Time
+	DryRun      bool
+	Jobs        []reportJob
+	Warnings    []string
+}
+
+type reportJob struct {
+	Template        string
+	Status          JobStatus
+	Name            string
+	DetailURL       string
+	ProjectId       int
+	SourceLanguage  string
+	TargetLanguages string
+	Error           string
+	Rollback        string
+	CustomFields    []reportCustomField
+	Files           []reportFile
+}
+
+type reportCustomField struct {
+	Name   string
+	Action string
+	Value  string
+}
+
+type reportFile struct {
+	Name  string
+	Size  string
+	Words string // Empty if the format can't be read
+}
+
+func newReport(submissions []JobSubmission) reportData {
+	report := reportData{}
+	report.Environment = moraviaEnvironment()
+	report.GeneratedAt = time.Now()
+
+	for _, submission := range submissions {
+		if submission.Status == JobSkipped {
+			report.DryRun = true
+		}
+
+		job := reportJob{}
+		job.Template = submission.Template
+		job.Status = submission.Status
+		job.Name = firstNonEmpty(maskSecrets(submission.Job.Name), submission.Template) // Not started jobs have no name yet
+		job.DetailURL = submission.DetailURL
+		job.ProjectId = submission.Job.ProjectId
+		job.SourceLanguage = submission.Job.SourceLanguageCode
+		job.TargetLanguages = strings.Join(submission.Job.TargetLanguageCodes, ", ")
+		job.Error = submission.Error
+		job.Rollback = submission.Rollback
+
+		changeSet := submission.CustomFields
+		for _, field := range changeSet.Created {
+			job.CustomFields = append(job.CustomFields, reportCustomField{customFieldKey(field), "created", maskSecrets(field.Value)})
+		}
+		for _, change := range changeSet.Updated {
+			job.CustomFields = append(job.CustomFields, reportCustomField{customFieldKey(change.Field), "updated", maskSecrets(change.NewValue)})
+		}
+		for _, field := range changeSet.Unchanged {
+			job.CustomFields = append(job.CustomFields, reportCustomField{customFieldKey(field), "unchanged", maskSecrets(field.Value)})
+		}
+		for _, field := range changeSet.Pruned {
+			job.CustomFields = append(job.CustomFields, reportCustomField{customFieldKey(field), changeSet.prunedAction(), ""})
+		}
+
+		for _, attachment := range submission.Attachments {
+			job.Files = append(job.Files, newReportFile(attachment.AttachmentFilePath))
+		}
+
+		report.Jobs = append(report.Jobs, job)
+	}
+
+	report.Warnings = collectedWarnings()
+	return report
+}
+
+func newReportFile(path string) reportFile {
+	file := reportFile{Name: filepath.Base(path)}
+	if info, err := os.Stat(path); err == nil {
+		file.Size = formatFileSize(info.Size())
+	}
+	if contents, err := ioutil.ReadFile(path); err == nil {
+		if localizableStrings, ok := readLocalizableStrings(path, contents); ok {
+			words := 0
+			for _, text := range localizableStrings {
+				words += len(strings.Fields(text))
+			}
+			file.Words = fmt.Sprint(words)
+			if words == 0 {
+				warn(file.Name + " has no strings to translate")
+			}
+		}
+	}
+	return file
+}
+
+func formatFileSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+// Table cells can't have pipes or newlines
+func markdownCell(s string) string {
+	s = strings.Replace(s, "|", "\\|", -1)
+	return strings.Replace(s, "\n", " ", -1)
+}
+
+var reportMarkdownTemplate = template.Must(template.New("report").Funcs(template.FuncMap{"cell": markdownCell}).Parse(`## Moravia {{.Environment}}{{if .DryRun}} (dry run){{end}}
+{{range .Jobs}}
+### {{if .DetailURL}}[{{cell .Name}}]({{.DetailURL}}){{else}}{{cell .Name}}{{end}}
+
+Template **{{.Template}}**, {{.Status}} in project {{.ProjectId}}. {{.SourceLanguage}} → {{.TargetLanguages}}
+{{if .Error}}
+**{{if eq .Status "cancelled"}}Cancelled{{else}}Failed{{end}}:** {{.Error}}{{if .Rollback}}. Rollback: {{.Rollback}}{{end}}
+{{end}}{{if .Files}}
+| File | Size | Words |
+| --- | --- | --- |
+{{range .Files}}| {{cell .Name}} | {{.Size}} | {{or .Words "?"}} |
+{{end}}{{end}}{{if .CustomFields}}
+| Custom field | Change | Value |
+| --- | --- | --- |
+{{range .CustomFields}}| {{cell .Name}} | {{.Action}} | {{cell .Value}} |
+{{end}}{{end}}{{end}}{{if .Warnings}}
+### Warnings
+{{range .Warnings}}
+- {{.}}{{end}}
+{{end}}`))
+
+var reportHTMLTemplate = htmltemplate.Must(htmltemplate.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Moravia {{.Environment}}</title>
+<style>
+body { font-family: -apple-system, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.warnings { color: #a15c00; }
+</style>
+</head>
+<body>
+<h1>Moravia {{.Environment}}{{if .DryRun}} (dry run){{end}}</h1>
+<p>{{.GeneratedAt.Format "2006-01-02 15:04 MST"}}</p>
+{{range .Jobs}}
+<h2>{{if .DetailURL}}<a href="{{.DetailURL}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</h2>
+<p>Template <b>{{.Template}}</b>, {{.Status}} in project {{.ProjectId}}. {{.SourceLanguage}} → {{.TargetLanguages}}</p>
+{{if .Error}}<p class="warnings"><b>{{if eq .Status "cancelled"}}Cancelled{{else}}Failed{{end}}:</b> {{.Error}}{{if .Rollback}}. Rollback: {{.Rollback}}{{end}}</p>{{end}}
+{{if .Files}}<table>
+<tr><th>File</th><th>Size</th><th>Words</th></tr>
+{{range .Files}}<tr><td>{{.Name}}</td><td>{{.Size}}</td><td>{{or .Words "?"}}</td></tr>
+{{end}}</table>{{end}}
+{{if .CustomFields}}<table>
+<tr><th>Custom field</th><th>Change</th><th>Value</th></tr>
+{{range .CustomFields}}<tr><td>{{.Name}}</td><td>{{.Action}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+{{if .Warnings}}<h2>Warnings</h2>
+<ul class="warnings">
+{{range .Warnings}}<li>{{.}}</li>
+{{end}}</ul>{{end}}
+</body>
+</html>
+`))
+
+func (report reportData) Markdown() (string, error) {
+	var out bytes.Buffer
+	err := reportMarkdownTemplate.Execute(&out, report)
+	return strings.TrimSpace(out.String()) + "\n", err
+}
+
+func (report reportData) HTML() (string, error) {
+	var out bytes.Buffer
+	err := reportHTMLTemplate.Execute(&out, report)
+	return out.String(), err
+}
+
+// Writes the Markdown and HTML reports next to the summary file, which the
+// Deploy to Bitrise.io step picks up as build artifacts
+func (report reportData) writeFiles(dir string) error {
+	markdown, err := report.Markdown()
+	if err != nil {
+		return err
+	}
+	html, err := report.HTML()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, reportMarkdownFileName), []byte(markdown), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, reportHTMLFileName), []byte(html), 0644)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Default name of the custom field a failed job is marked with when it can't be deleted
+const defaultFailureCustomField = "Automation Error"
+
+var errJobDeletionNotAllowed = errors.New("not allowed to delete jobs")
+
+func deleteJob(ctx context.Context, auth AuthenticateResponse, jobId int) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", moraviaJobsURL()+"("+strconv.Itoa(jobId)+")", nil)
+	if err != nil {
+		return err
+	}
+	authorization_value := "Bearer " + auth.Access_token
+	req.Header.Set("Authorization", authorization_value)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusForbidden, http.StatusMethodNotAllowed:
+		return errJobDeletionNotAllowed
+	default:
+		return fmt.Errorf("failed to delete job %d: %s", jobId, resp.Status)
+	}
+}
+
+// Undoes a submission that failed after its job was created. Its custom fields
+// and attachments go with the job, so only the job is deleted. If the account
+// isn't allowed to delete jobs, the job is marked with the template's
+// failure_custom_field instead so nobody starts work on it. Returns what was
+// done, and whether the job was dealt with. This runs after the submission is
+// cancelled too, so it doesn't take the run's context.
+func rollbackJob(auth AuthenticateResponse, template MoraviaJobTemplateConfiguration, job Job, cause error) (string, bool) {
+	if job.Id == 0 {
+		return "", true
+	}
+	ctx, cancel := rollbackContext()
+	defer cancel()
+
+	err := deleteJob(ctx, auth, job.Id)
+	if err == nil {
+		logs.Warn("Rolled back, deleted job", "id", job.Id)
+		return fmt.Sprintf("deleted job %d", job.Id), true
+	}
+	if err != errJobDeletionNotAllowed {
+		logs.Error("Rollback failed, job "+strconv.Itoa(job.Id)+" is left in Moravia", "error", err)
+		return fmt.Sprintf("job %d is left in Moravia: %s", job.Id, err), false
+	}
+
+	name := firstNonEmpty(template.Failure_custom_field, defaultFailureCustomField)
+	field := JobCustomField{}
+	field.HandoffId = job.Id
+	field.Name = name
+	field.Group = template.Custom_field_defaults.Group
+	field.Value = redact("Submission failed: " + cause.Error())
+	field.InternalPermission = Edit
+	field.NonInternalPermission = Read
+	if err := createJobCustomField(ctx, auth, field, &field); err != nil {
+		logs.Error("Rollback failed, job "+strconv.Itoa(job.Id)+" can't be deleted or marked", "error", err)
+		return fmt.Sprintf("failed to mark job %d: %s", job.Id, err), false
+	}
+	logs.Warn("Rolled back, job can't be deleted so it's marked with custom field \""+name+"\"", "id", job.Id)
+	return fmt.Sprintf("marked job %d with custom field \"%s\"", job.Id, name), true
+}
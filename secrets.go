@@ -0,0 +1,54 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const maskedSecret = "[REDACTED]"
+
+var secretValues = struct {
+	sync.Mutex
+	values []string
+}{}
+
+var secretVariableName = regexp.MustCompile(`(?i)(SECRET|TOKEN|PASSWORD|PASSWD|PRIVATE|API_?KEY|CREDENTIAL)`)
+
+// Variables are secret if their name says so or they're listed in moravia_secret_env_vars
+func isSecretEnvironmentVariable(name string) bool {
+	if secretVariableName.MatchString(name) {
+		return true
+	}
+	for _, secret := range strings.Split(getenv("moravia_secret_env_vars", ""), ",") {
+		if strings.TrimSpace(secret) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Masks value wherever maskSecrets is used from now on
+func registerSecret(value string) {
+	// Very short values would mask unrelated output
+	if len(value) < 4 {
+		return
+	}
+	secretValues.Lock()
+	defer secretValues.Unlock()
+	for _, existing := range secretValues.values {
+		if existing == value {
+			return
+		}
+	}
+	secretValues.values = append(secretValues.values, value)
+}
+
+func maskSecrets(s string) string {
+	secretValues.Lock()
+	defer secretValues.Unlock()
+	for _, value := range secretValues.values {
+		s = strings.Replace(s, value, maskedSecret, -1)
+	}
+	return s
+}
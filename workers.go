@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Job templates, custom field writes and uploads are done moravia_concurrency
+// at a time, 4 by default
+func concurrency() int {
+	n, err := strconv.Atoi(getenv("moravia_concurrency", "4"))
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Runs tasks on up to workers goroutines and returns their errors in task
+// order. Once ctx is done, tasks that haven't started get its error instead.
+func runWorkers(ctx context.Context, workers int, tasks []func(ctx context.Context) error) []error {
+	errs := make([]error, len(tasks))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(tasks); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				errs[i] = tasks[i](ctx)
+			}
+		}()
+	}
+	for i := range tasks {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return errs
+}
+
+// Several errors from one batch of tasks, in task order
+type multiError []error
+
+func (errs multiError) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d errors: %s", len(errs), strings.Join(messages, "; "))
+}
+
+// nil if every error is
+func joinErrors(errs []error) error {
+	var failed multiError
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed
+}
+
+// Bounds the uploads and custom field writes in flight across every worker
+// pool, so submitting templates in parallel doesn't multiply them
+var writeLimiter = make(chan struct{}, concurrency())
+
+// Waits for a slot, or until ctx is done. Call the returned func to give it back.
+func acquireWrite(ctx context.Context) (func(), error) {
+	select {
+	case writeLimiter <- struct{}{}:
+		return func() { <-writeLimiter }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}